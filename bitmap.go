@@ -11,8 +11,11 @@ import (
 )
 
 type Bitmap struct {
-	size uint32
-	bits []uint64
+	size    uint32
+	bits    []uint64
+	cursor  uint32     // where the next NextFit search starts
+	index   *rankIndex // built by BuildRankIndex, dropped by every mutation
+	version uint64     // bumped by every mutation, see BitmapPatch
 }
 
 func NewBitmap(size uint32) *Bitmap {
@@ -39,18 +42,24 @@ func mask(bitAt int) uint64 {
 	return (0x8000000000000000 >> bitAt)
 }
 
-// Set sets the bit x in the bitmap and grows it if necessary.
+// Set sets the bit x in the bitmap and grows it if necessary. Size is raised
+// to at least x, so Contains, Count and the iterators see the bit.
 func (b *Bitmap) Set(x uint32) {
+	b.changed()
 	blkAt, bitAt := loc(x)
 	if size := len(b.bits); blkAt >= size {
 		b.grow(blkAt)
 	}
 
+	if x > b.size {
+		b.resize(x)
+	}
 	b.bits[blkAt] |= mask(bitAt)
 }
 
 // Remove removes the bit x from the bitmap, but does not shrink it.
 func (b *Bitmap) Remove(x uint32) {
+	b.changed()
 	blkAt, bitAt := loc(x)
 	if blkAt < len(b.bits) {
 		b.bits[blkAt] &^= mask(bitAt)
@@ -68,6 +77,7 @@ func (b *Bitmap) Contains(x uint32) bool {
 
 // Ones sets the entire bitmap to one.
 func (b *Bitmap) Ones() {
+	b.changed()
 	size := len(b.bits)
 	for i := 0; i < size; i++ {
 		b.bits[i] = 0xffffffffffffffff
@@ -158,9 +168,10 @@ func (b *Bitmap) CountTo(until uint32) int {
 
 // Grow grows the bitmap size until we reach the desired bit.
 func (b *Bitmap) Grow(desiredBit uint32) {
-	b.size = desiredBit
+	b.changed()
 	blk, _ := loc(desiredBit)
 	b.grow(blk)
+	b.resize(desiredBit)
 }
 
 // Count returns the number of elements in this bitmap
@@ -170,74 +181,84 @@ func (b *Bitmap) Count() int {
 
 // And computes the intersection between two bitmaps and stores the result in the current bitmap
 func (a *Bitmap) And(other Bitmap, extra ...Bitmap) {
+	a.changed()
 	a.size = minsize(*a, other, extra)
 	max := minlen(*a, other, extra)
 	a.shrink(max)
-	for i := 0; i < max; i++ {
-		a.bits[i] = a.bits[i] &^ other.bits[i]
-	}
 
-	for _, b := range extra {
-		for i := 0; i < max; i++ {
-			a.bits[i] = a.bits[i] &^ b.bits[i]
+	// one pass over the words for all of the bitmaps
+	for i := 0; i < max; i++ {
+		blk := a.bits[i] & other.bits[i]
+		for j := range extra {
+			blk &= extra[j].bits[i]
 		}
+		a.bits[i] = blk
 	}
 }
 
 // AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
 // Operation works as set subtract: a - b
 func (a *Bitmap) AndNot(other Bitmap, extra ...Bitmap) {
-	a.size = minsize(*a, other, extra)
-	max := minlen(*a, other, extra)
-
-	for i := 0; i < max; i++ {
-		a.bits[i] = a.bits[i] &^ other.bits[i]
-	}
-
-	for _, b := range extra {
-		for i := 0; i < max; i++ {
-			a.bits[i] = a.bits[i] &^ b.bits[i]
+	a.changed()
+	for i := range a.bits {
+		blk := a.bits[i]
+		if i < len(other.bits) {
+			blk &^= other.bits[i]
 		}
+		for j := range extra {
+			if i < len(extra[j].bits) {
+				blk &^= extra[j].bits[i]
+			}
+		}
+		a.bits[i] = blk
 	}
-
 }
 
 // Or computes the union between two bitmaps and stores the result in the current bitmap
 func (a *Bitmap) Or(other Bitmap, extra ...Bitmap) {
+	a.changed()
 	a.size = maxsize(*a, other, extra)
 	max := maxlen(*a, other, extra)
 	a.grow(max - 1)
 
-	for i := 0; i < len(other.bits); i++ {
-		a.bits[i] = a.bits[i] | other.bits[i]
-	}
-
-	for _, b := range extra {
-		for i := 0; i < len(b.bits); i++ {
-			a.bits[i] = a.bits[i] | b.bits[i]
+	for i := 0; i < max; i++ {
+		blk := a.bits[i]
+		if i < len(other.bits) {
+			blk |= other.bits[i]
 		}
+		for j := range extra {
+			if i < len(extra[j].bits) {
+				blk |= extra[j].bits[i]
+			}
+		}
+		a.bits[i] = blk
 	}
 }
 
 // Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap
 func (a *Bitmap) Xor(other Bitmap, extra ...Bitmap) {
+	a.changed()
 	a.size = maxsize(*a, other, extra)
 	max := maxlen(*a, other, extra)
 	a.grow(max - 1)
 
-	for i := 0; i < len(other.bits); i++ {
-		a.bits[i] = a.bits[i] ^ other.bits[i]
-	}
-
-	for _, b := range extra {
-		for i := 0; i < len(b.bits); i++ {
-			a.bits[i] = a.bits[i] ^ b.bits[i]
+	for i := 0; i < max; i++ {
+		blk := a.bits[i]
+		if i < len(other.bits) {
+			blk ^= other.bits[i]
+		}
+		for j := range extra {
+			if i < len(extra[j].bits) {
+				blk ^= extra[j].bits[i]
+			}
 		}
+		a.bits[i] = blk
 	}
 }
 
 // Clear clears the bitmap and resizes it to zero.
 func (b *Bitmap) Clear() {
+	b.changed()
 	for i := range b.bits {
 		b.bits[i] = 0
 	}
@@ -340,6 +361,7 @@ func (b *Bitmap) ToBytes() (out []byte) {
 		return nil
 	}
 
+	b.invalidate()
 	bits := b.bits
 	for l, r := 0, len(bits)-1; l < r; l, r = l+1, r-1 {
 		bits[l], bits[r] = bits[r], bits[l]
@@ -369,6 +391,17 @@ func (b *Bitmap) grow(blkAt int) {
 	copy(b.bits, old)
 }
 
+// resize sets the size of the bitmap, the bits exposed by growing it are
+// cleared since they may be left over from a smaller size.
+func (b *Bitmap) resize(size uint32) {
+	if size > b.size {
+		b.applyRange(b.size+1, size, func(blkAt int, m uint64) {
+			b.bits[blkAt] &^= m
+		})
+	}
+	b.size = size
+}
+
 // shrink shrinks the size of the bitmap and resets to zero
 func (b *Bitmap) shrink(length int) {
 	until := len(b.bits)
@@ -387,7 +420,7 @@ func minsize(a, b Bitmap, extra []Bitmap) uint32 {
 	}
 	for _, v := range extra {
 		if size > v.size {
-			size = b.size
+			size = v.size
 		}
 	}
 	return size
@@ -411,7 +444,7 @@ func maxsize(a, b Bitmap, extra []Bitmap) uint32 {
 	}
 	for _, v := range extra {
 		if size < v.size {
-			size = b.size
+			size = v.size
 		}
 	}
 	return size
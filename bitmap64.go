@@ -0,0 +1,571 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"sort"
+)
+
+// Bitmap64 is a bitmap of uint64 values, indexed from 1 like Bitmap. Values are
+// sharded by the high 32 bits of x-1, and each shard keeps its low 32 bits in
+// chunks of 2^16 values. A chunk is a Bitmap of at most 1024 words, so sparse
+// values in a shard only allocate the chunks in use rather than the words up
+// to the highest offset. The chunks of every shard are kept in one list
+// sorted by their key, the high 48 bits of x-1.
+type Bitmap64 struct {
+	keys   []uint64
+	chunks []*Bitmap
+}
+
+const (
+	bitmap64ChunkBits  = 16
+	bitmap64ChunkWords = 1 << bitmap64ChunkBits / 64
+	bitmap64LastChunk  = 1<<(64-bitmap64ChunkBits) - 1
+)
+
+func NewBitmap64() *Bitmap64 {
+	return &Bitmap64{}
+}
+
+// loc64 returns the chunk key of x and the offset of x in the chunk. Chunks
+// are addressed by offset on the words rather than through the Bitmap
+// methods, which index from 1.
+func loc64(x uint64) (key uint64, offset uint32) {
+	return (x - 1) >> bitmap64ChunkBits, uint32(x-1) & (1<<bitmap64ChunkBits - 1)
+}
+
+// Set sets the bit x in the bitmap.
+func (b *Bitmap64) Set(x uint64) {
+	if x == 0 {
+		return
+	}
+	key, offset := loc64(x)
+	i, found := b.search(key)
+	if !found {
+		b.keys = append(b.keys, 0)
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+		b.chunks = append(b.chunks, nil)
+		copy(b.chunks[i+1:], b.chunks[i:])
+		b.chunks[i] = &Bitmap{}
+	}
+
+	chunk := b.chunks[i]
+	blkAt := int(offset >> 6)
+	chunk.grow(blkAt)
+	chunk.bits[blkAt] |= mask(int(offset & 63))
+}
+
+// Remove removes the bit x from the bitmap.
+func (b *Bitmap64) Remove(x uint64) {
+	if x == 0 {
+		return
+	}
+	key, offset := loc64(x)
+	i, found := b.search(key)
+	if !found {
+		return
+	}
+
+	chunk := b.chunks[i]
+	if blkAt := int(offset >> 6); blkAt < len(chunk.bits) {
+		chunk.bits[blkAt] &^= mask(int(offset & 63))
+	}
+	if trimChunk(chunk) {
+		b.removeAt(i)
+	}
+}
+
+// Contains checks whether a value is contained in the bitmap or not.
+func (b *Bitmap64) Contains(x uint64) bool {
+	if x == 0 {
+		return false
+	}
+	key, offset := loc64(x)
+	i, found := b.search(key)
+	if !found {
+		return false
+	}
+	blkAt := int(offset >> 6)
+	return blkAt < len(b.chunks[i].bits) && b.chunks[i].bits[blkAt]&mask(int(offset&63)) != 0
+}
+
+// Min get the smallest value stored in this bitmap, assuming the bitmap is not empty.
+func (b *Bitmap64) Min() (uint64, bool) {
+	return b.NextSet(1)
+}
+
+// Max get the largest value stored in this bitmap, assuming the bitmap is not empty.
+func (b *Bitmap64) Max() (uint64, bool) {
+	for i := len(b.chunks) - 1; i >= 0; i-- {
+		words := b.chunks[i].bits
+		for blkAt := len(words) - 1; blkAt >= 0; blkAt-- {
+			if blk := words[blkAt]; blk != 0 {
+				offset := uint64(blkAt)<<6 + 63 - uint64(bits.TrailingZeros64(blk))
+				return b.keys[i]<<bitmap64ChunkBits + offset + 1, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// MinZero finds the first zero bit and returns its index.
+func (b *Bitmap64) MinZero() (uint64, bool) {
+	return b.NextClear(1)
+}
+
+// Count returns the number of elements in this bitmap
+func (b *Bitmap64) Count() int {
+	sum := 0
+	for _, chunk := range b.chunks {
+		sum += count(chunk.bits)
+	}
+	return sum
+}
+
+// Clear removes all the elements from the bitmap.
+func (b *Bitmap64) Clear() {
+	b.keys = b.keys[:0]
+	b.chunks = b.chunks[:0]
+}
+
+// NextSet finds the first set bit which is greater than or equal to from.
+func (b *Bitmap64) NextSet(from uint64) (uint64, bool) {
+	it := Bitmap64Iterator{bitmap: b}
+	it.Seek(from)
+	return it.Next()
+}
+
+// NextClear finds the first zero bit which is greater than or equal to from.
+func (b *Bitmap64) NextClear(from uint64) (uint64, bool) {
+	if from == 0 {
+		from = 1
+	}
+	for {
+		key, offset := loc64(from)
+		i, found := b.search(key)
+		if !found {
+			return from, true
+		}
+
+		words := b.chunks[i].bits
+		base := key << bitmap64ChunkBits
+		blkAt := int(offset >> 6)
+		if blkAt >= len(words) {
+			return from, true
+		}
+		for blk := ^words[blkAt] & (0xffffffffffffffff >> (offset & 63)); ; blk = ^words[blkAt] {
+			if blk != 0 {
+				// the last bit of the last chunk would be 2^64, which wraps to 0
+				x := base + uint64(blkAt)<<6 + uint64(bits.LeadingZeros64(blk)) + 1
+				return x, x != 0
+			}
+			if blkAt++; blkAt >= len(words) {
+				break
+			}
+		}
+		if len(words) < bitmap64ChunkWords {
+			return base + uint64(len(words))<<6 + 1, true
+		}
+		if key == bitmap64LastChunk {
+			return 0, false
+		}
+		from = base + 1<<bitmap64ChunkBits + 1
+	}
+}
+
+// PrevSet finds the last set bit which is less than or equal to from.
+func (b *Bitmap64) PrevSet(from uint64) (uint64, bool) {
+	if from == 0 {
+		return 0, false
+	}
+	key, offset := loc64(from)
+	i, found := b.search(key)
+	if !found {
+		i--
+	}
+	for ; i >= 0; i-- {
+		words := b.chunks[i].bits
+		blkAt := len(words) - 1
+		blk := words[blkAt]
+		if found {
+			if at := int(offset >> 6); at <= blkAt {
+				blkAt = at
+				blk = words[blkAt] &^ (0xffffffffffffffff >> (offset&63 + 1))
+			}
+			found = false
+		}
+		for {
+			if blk != 0 {
+				offset := uint64(blkAt)<<6 + 63 - uint64(bits.TrailingZeros64(blk))
+				return b.keys[i]<<bitmap64ChunkBits + offset + 1, true
+			}
+			if blkAt--; blkAt < 0 {
+				break
+			}
+			blk = words[blkAt]
+		}
+	}
+	return 0, false
+}
+
+// ForEach calls f for every set bit in ascending order until f returns false.
+func (b *Bitmap64) ForEach(f func(x uint64) bool) {
+	b.ForEachRange(1, 0xffffffffffffffff, f)
+}
+
+// ForEachRange calls f for every set bit between lo and hi inclusive in
+// ascending order until f returns false.
+func (b *Bitmap64) ForEachRange(lo, hi uint64, f func(x uint64) bool) {
+	it := Bitmap64Iterator{bitmap: b}
+	it.Seek(lo)
+	for x, ok := it.Next(); ok && x <= hi; x, ok = it.Next() {
+		if !f(x) {
+			return
+		}
+	}
+}
+
+// Bitmap64Iterator walks the set bits of a Bitmap64 in ascending order,
+// skipping whole zero words. It can be reused for another bitmap with Reset.
+type Bitmap64Iterator struct {
+	bitmap *Bitmap64
+	chunk  int
+	blkAt  int
+	blk    uint64
+}
+
+// Iterator returns an iterator positioned at the first bit of the bitmap.
+func (b *Bitmap64) Iterator() *Bitmap64Iterator {
+	it := &Bitmap64Iterator{}
+	it.Reset(b)
+	return it
+}
+
+// Reset points the iterator to the first bit of the given bitmap.
+func (it *Bitmap64Iterator) Reset(b *Bitmap64) {
+	it.bitmap = b
+	it.Seek(1)
+}
+
+// Seek moves the iterator so the next call to Next returns the first set bit
+// which is greater than or equal to from.
+func (it *Bitmap64Iterator) Seek(from uint64) {
+	if from == 0 {
+		from = 1
+	}
+	key, offset := loc64(from)
+	i, found := it.bitmap.search(key)
+	it.chunk, it.blkAt, it.blk = i, -1, 0
+	if !found {
+		return
+	}
+	words := it.bitmap.chunks[i].bits
+	if blkAt := int(offset >> 6); blkAt < len(words) {
+		it.blkAt, it.blk = blkAt, words[blkAt]&(0xffffffffffffffff>>(offset&63))
+	} else {
+		it.chunk++
+	}
+}
+
+// Next returns the next set bit, or false when the iteration is over.
+func (it *Bitmap64Iterator) Next() (uint64, bool) {
+	for it.blk == 0 {
+		if it.chunk >= len(it.bitmap.chunks) {
+			return 0, false
+		}
+		words := it.bitmap.chunks[it.chunk].bits
+		if it.blkAt+1 < len(words) {
+			it.blkAt++
+			it.blk = words[it.blkAt]
+			continue
+		}
+		it.chunk, it.blkAt = it.chunk+1, -1
+	}
+
+	bitAt := bits.LeadingZeros64(it.blk)
+	it.blk &^= mask(bitAt)
+	return it.bitmap.keys[it.chunk]<<bitmap64ChunkBits + uint64(it.blkAt)<<6 + uint64(bitAt) + 1, true
+}
+
+// And computes the intersection between two bitmaps and stores the result in the current bitmap
+func (a *Bitmap64) And(other Bitmap64, extra ...Bitmap64) {
+	a.and(&other)
+	for i := range extra {
+		a.and(&extra[i])
+	}
+}
+
+// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
+// Operation works as set subtract: a - b
+func (a *Bitmap64) AndNot(other Bitmap64, extra ...Bitmap64) {
+	a.andNot(&other)
+	for i := range extra {
+		a.andNot(&extra[i])
+	}
+}
+
+// Or computes the union between two bitmaps and stores the result in the current bitmap
+func (a *Bitmap64) Or(other Bitmap64, extra ...Bitmap64) {
+	a.merge(&other, func(x, y uint64) uint64 { return x | y })
+	for i := range extra {
+		a.merge(&extra[i], func(x, y uint64) uint64 { return x | y })
+	}
+}
+
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap
+func (a *Bitmap64) Xor(other Bitmap64, extra ...Bitmap64) {
+	a.merge(&other, func(x, y uint64) uint64 { return x ^ y })
+	for i := range extra {
+		a.merge(&extra[i], func(x, y uint64) uint64 { return x ^ y })
+	}
+}
+
+func (a *Bitmap64) and(b *Bitmap64) {
+	keys, chunks := a.keys[:0], a.chunks[:0]
+	for i, j := 0, 0; i < len(a.keys) && j < len(b.keys); {
+		switch {
+		case a.keys[i] < b.keys[j]:
+			i++
+		case a.keys[i] > b.keys[j]:
+			j++
+		default:
+			x, y := a.chunks[i], b.chunks[j]
+			x.shrink(minint(len(x.bits), len(y.bits)))
+			for k := range x.bits {
+				x.bits[k] &= y.bits[k]
+			}
+			if !trimChunk(x) {
+				keys = append(keys, a.keys[i])
+				chunks = append(chunks, x)
+			}
+			i++
+			j++
+		}
+	}
+	a.keys, a.chunks = keys, chunks
+}
+
+func (a *Bitmap64) andNot(b *Bitmap64) {
+	keys, chunks := a.keys[:0], a.chunks[:0]
+	for i, j := 0, 0; i < len(a.keys); i++ {
+		for j < len(b.keys) && b.keys[j] < a.keys[i] {
+			j++
+		}
+		x := a.chunks[i]
+		if j < len(b.keys) && b.keys[j] == a.keys[i] {
+			y := b.chunks[j]
+			for k := 0; k < len(x.bits) && k < len(y.bits); k++ {
+				x.bits[k] &^= y.bits[k]
+			}
+		}
+		if !trimChunk(x) {
+			keys = append(keys, a.keys[i])
+			chunks = append(chunks, x)
+		}
+	}
+	a.keys, a.chunks = keys, chunks
+}
+
+// merge combines the chunks of both bitmaps, chunks found only in b are copied.
+func (a *Bitmap64) merge(b *Bitmap64, op func(x, y uint64) uint64) {
+	keys := make([]uint64, 0, len(a.keys)+len(b.keys))
+	chunks := make([]*Bitmap, 0, len(a.keys)+len(b.keys))
+	i, j := 0, 0
+	for i < len(a.keys) || j < len(b.keys) {
+		switch {
+		case j == len(b.keys) || (i < len(a.keys) && a.keys[i] < b.keys[j]):
+			keys = append(keys, a.keys[i])
+			chunks = append(chunks, a.chunks[i])
+			i++
+		case i == len(a.keys) || a.keys[i] > b.keys[j]:
+			keys = append(keys, b.keys[j])
+			chunks = append(chunks, &Bitmap{bits: append([]uint64(nil), b.chunks[j].bits...)})
+			j++
+		default:
+			x, y := a.chunks[i], b.chunks[j]
+			if len(y.bits) > 0 {
+				x.grow(len(y.bits) - 1)
+			}
+			for k := range y.bits {
+				x.bits[k] = op(x.bits[k], y.bits[k])
+			}
+			if !trimChunk(x) {
+				keys = append(keys, a.keys[i])
+				chunks = append(chunks, x)
+			}
+			i++
+			j++
+		}
+	}
+	a.keys, a.chunks = keys, chunks
+}
+
+func (b *Bitmap64) search(key uint64) (int, bool) {
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= key })
+	return i, i < len(b.keys) && b.keys[i] == key
+}
+
+func (b *Bitmap64) removeAt(i int) {
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	b.chunks = append(b.chunks[:i], b.chunks[i+1:]...)
+}
+
+// trimChunk drops the trailing zero words of the chunk and returns true if it is empty.
+func trimChunk(chunk *Bitmap) bool {
+	n := len(chunk.bits)
+	for n > 0 && chunk.bits[n-1] == 0 {
+		n--
+	}
+	chunk.bits = chunk.bits[:n]
+	return n == 0
+}
+
+// bitmap64JSON is the serialized form of Bitmap64, each chunk holds its
+// little-endian words which are base64 encoded by encoding/json.
+type bitmap64JSON struct {
+	Chunks []bitmap64ChunkJSON `json:"chunks,omitempty"`
+}
+
+type bitmap64ChunkJSON struct {
+	Key  uint64 `json:"key"`
+	Data []byte `json:"data"`
+}
+
+func (b *Bitmap64) MarshalJSON() ([]byte, error) {
+	out := bitmap64JSON{}
+	for i, chunk := range b.chunks {
+		data := make([]byte, 8*len(chunk.bits))
+		for k, blk := range chunk.bits {
+			binary.LittleEndian.PutUint64(data[8*k:], blk)
+		}
+		out.Chunks = append(out.Chunks, bitmap64ChunkJSON{Key: b.keys[i], Data: data})
+	}
+	return json.Marshal(out)
+}
+
+func (b *Bitmap64) UnmarshalJSON(data []byte) error {
+	in := bitmap64JSON{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	out := Bitmap64{}
+	for _, cj := range in.Chunks {
+		if err := out.appendChunk(cj.Key, cj.Data); err != nil {
+			return err
+		}
+	}
+	*b = out
+	return nil
+}
+
+// Binary format of a Bitmap64, integers are big-endian:
+//
+//	magic   [2]byte  "B6"
+//	version uint8    bitmap64BinaryVersion
+//	count   uint32   number of chunks
+//	count times:
+//	  key   uint64   high 48 bits of x-1
+//	  words uint16   number of words, up to 1024
+//	  data  [words]uint64, little-endian
+//	crc     uint32   IEEE CRC-32 of everything before it
+const (
+	bitmap64BinaryVersion uint8 = 1
+	bitmap64BinaryHeader        = 7
+)
+
+var bitmap64BinaryMagic = [2]byte{'B', '6'}
+
+// MarshalBinary encodes the bitmap in a compact binary form.
+func (b *Bitmap64) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, bitmap64BinaryHeader)
+	copy(buf, bitmap64BinaryMagic[:])
+	buf[2] = bitmap64BinaryVersion
+	binary.BigEndian.PutUint32(buf[3:], uint32(len(b.keys)))
+
+	var hdr [10]byte
+	var word [8]byte
+	for i, chunk := range b.chunks {
+		binary.BigEndian.PutUint64(hdr[:], b.keys[i])
+		binary.BigEndian.PutUint16(hdr[8:], uint16(len(chunk.bits)))
+		buf = append(buf, hdr[:]...)
+		for _, blk := range chunk.bits {
+			binary.LittleEndian.PutUint64(word[:], blk)
+			buf = append(buf, word[:]...)
+		}
+	}
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(buf))
+	return append(buf, crc[:]...), nil
+}
+
+// UnmarshalBinary decodes a bitmap encoded by MarshalBinary.
+func (b *Bitmap64) UnmarshalBinary(data []byte) error {
+	if len(data) < bitmap64BinaryHeader+4 {
+		return fmt.Errorf("bitmap: binary data too short, length %d", len(data))
+	}
+	if data[0] != bitmap64BinaryMagic[0] || data[1] != bitmap64BinaryMagic[1] {
+		return fmt.Errorf("bitmap: binary data has bad magic %q", data[:2])
+	}
+	if data[2] != bitmap64BinaryVersion {
+		return fmt.Errorf("bitmap: unsupported binary version %d", data[2])
+	}
+
+	crcAt := len(data) - 4
+	if crc := crc32.ChecksumIEEE(data[:crcAt]); crc != binary.BigEndian.Uint32(data[crcAt:]) {
+		return fmt.Errorf("bitmap: binary data checksum mismatch")
+	}
+
+	out := Bitmap64{}
+	count := binary.BigEndian.Uint32(data[3:])
+	body := data[bitmap64BinaryHeader:crcAt]
+	for i := uint32(0); i < count; i++ {
+		if len(body) < 10 {
+			return fmt.Errorf("bitmap: binary data truncated at chunk %d", i)
+		}
+		key, n := binary.BigEndian.Uint64(body), int(binary.BigEndian.Uint16(body[8:]))
+		if 8*n > len(body)-10 {
+			return fmt.Errorf("bitmap: binary data truncated at chunk %d", i)
+		}
+		if err := out.appendChunk(key, body[10:10+8*n]); err != nil {
+			return err
+		}
+		body = body[10+8*n:]
+	}
+	if len(body) != 0 {
+		return fmt.Errorf("bitmap: binary data has %d trailing bytes", len(body))
+	}
+
+	*b = out
+	return nil
+}
+
+// appendChunk decodes the little-endian words of a chunk and appends it, keys
+// have to be appended in ascending order.
+func (b *Bitmap64) appendChunk(key uint64, data []byte) error {
+	if n := len(b.keys); n > 0 && b.keys[n-1] >= key {
+		return fmt.Errorf("bitmap: chunk keys are not sorted at %d", key)
+	}
+	if key > bitmap64LastChunk {
+		return fmt.Errorf("bitmap: chunk key %d is out of range", key)
+	}
+	if len(data)%8 != 0 || len(data) > 8*bitmap64ChunkWords {
+		return fmt.Errorf("bitmap: chunk length expected to be multiple of 8 up to %d, was %d", 8*bitmap64ChunkWords, len(data))
+	}
+
+	chunk := &Bitmap{bits: make([]uint64, len(data)/8)}
+	for k := range chunk.bits {
+		chunk.bits[k] = binary.LittleEndian.Uint64(data[8*k:])
+	}
+	if trimChunk(chunk) {
+		return nil
+	}
+	b.keys = append(b.keys, key)
+	b.chunks = append(b.chunks, chunk)
+	return nil
+}
@@ -0,0 +1,114 @@
+package utils
+
+import "math/bits"
+
+// Clone returns a copy of the bitmap which shares no memory with it.
+func (b *Bitmap) Clone() *Bitmap {
+	return &Bitmap{
+		size:    b.size,
+		bits:    append([]uint64(nil), b.bits...),
+		cursor:  b.cursor,
+		version: b.version,
+	}
+}
+
+// Union returns a new bitmap with the bits set in a or b, sized to the larger one.
+func (a *Bitmap) Union(b *Bitmap) *Bitmap {
+	return combine(a, b, maxuint32(a.size, b.size), func(x, y uint64) uint64 { return x | y })
+}
+
+// Intersection returns a new bitmap with the bits set in both a and b, sized to the smaller one.
+func (a *Bitmap) Intersection(b *Bitmap) *Bitmap {
+	return combine(a, b, minuint32(a.size, b.size), func(x, y uint64) uint64 { return x & y })
+}
+
+// Difference returns a new bitmap with the bits set in a but not in b, sized as a.
+func (a *Bitmap) Difference(b *Bitmap) *Bitmap {
+	return combine(a, b, a.size, func(x, y uint64) uint64 { return x &^ y })
+}
+
+// SymmetricDifference returns a new bitmap with the bits set in only one of a
+// and b, sized to the larger one.
+func (a *Bitmap) SymmetricDifference(b *Bitmap) *Bitmap {
+	return combine(a, b, maxuint32(a.size, b.size), func(x, y uint64) uint64 { return x ^ y })
+}
+
+// Equal checks whether both bitmaps have the same size and the same bits set.
+func (a *Bitmap) Equal(b *Bitmap) bool {
+	if a.size != b.size {
+		return false
+	}
+	for i, words := 0, bitmapWords(a.size); i < words; i++ {
+		if a.word(i) != b.word(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSubsetOf checks whether every bit set in a is also set in b.
+func (a *Bitmap) IsSubsetOf(b *Bitmap) bool {
+	for i, words := 0, bitmapWords(a.size); i < words; i++ {
+		if a.word(i)&^b.word(i) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersects checks whether a and b have at least one bit set in common.
+func (a *Bitmap) Intersects(b *Bitmap) bool {
+	for i, words := 0, bitmapWords(minuint32(a.size, b.size)); i < words; i++ {
+		if a.word(i)&b.word(i) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IntersectionCount returns the number of bits set in both a and b.
+func (a *Bitmap) IntersectionCount(b *Bitmap) int {
+	sum := 0
+	for i, words := 0, bitmapWords(minuint32(a.size, b.size)); i < words; i++ {
+		sum += bits.OnesCount64(a.word(i) & b.word(i))
+	}
+	return sum
+}
+
+// combine applies op word by word on a and b into a new bitmap of the given size.
+func combine(a, b *Bitmap, size uint32, op func(x, y uint64) uint64) *Bitmap {
+	out := NewBitmap(size)
+	for i, words := 0, bitmapWords(size); i < words; i++ {
+		out.bits[i] = op(a.word(i), b.word(i))
+	}
+	return out
+}
+
+// word returns the block i with the bits beyond size cleared, or zero if the
+// block is beyond size.
+func (b *Bitmap) word(i int) uint64 {
+	words := bitmapWords(b.size)
+	if i >= words || i >= len(b.bits) {
+		return 0
+	}
+	blk := b.bits[i]
+	if i == words-1 {
+		_, bitAt := loc(b.size)
+		blk &^= 0xffffffffffffffff >> (bitAt + 1)
+	}
+	return blk
+}
+
+func maxuint32(v1, v2 uint32) uint32 {
+	if v1 > v2 {
+		return v1
+	}
+	return v2
+}
+
+func minuint32(v1, v2 uint32) uint32 {
+	if v1 < v2 {
+		return v1
+	}
+	return v2
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Binary format of a bitmap, header fields are big-endian:
+//
+//	magic   [2]byte  "BM"
+//	version uint8    bitmapBinaryVersion
+//	flags   uint8    bitmapFlagBigEndian if the words are big-endian
+//	size    uint32   logical size of the bitmap
+//	words   [n]uint64 n = ceil(size / 64), in the byte order given by flags
+//	crc     uint32   IEEE CRC-32 of everything before it
+const (
+	bitmapBinaryVersion uint8 = 1
+	bitmapBinaryHeader        = 8
+	bitmapFlagBigEndian uint8 = 0x01
+)
+
+var bitmapBinaryMagic = [2]byte{'B', 'M'}
+
+// MarshalBinary encodes the bitmap with little-endian words, the bitmap is not modified.
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+	return b.MarshalBinaryWithOrder(binary.LittleEndian)
+}
+
+// MarshalBinaryWithOrder encodes the bitmap with the words in the given byte
+// order, which is either binary.LittleEndian or binary.BigEndian.
+func (b *Bitmap) MarshalBinaryWithOrder(order binary.ByteOrder) ([]byte, error) {
+	var flags uint8
+	switch order {
+	case binary.LittleEndian:
+	case binary.BigEndian:
+		flags |= bitmapFlagBigEndian
+	default:
+		return nil, fmt.Errorf("bitmap: unsupported byte order %s", order)
+	}
+
+	words := bitmapWords(b.size)
+	buf := make([]byte, bitmapBinaryHeader+8*words+4)
+	copy(buf, bitmapBinaryMagic[:])
+	buf[2] = bitmapBinaryVersion
+	buf[3] = flags
+	binary.BigEndian.PutUint32(buf[4:], b.size)
+
+	data := buf[bitmapBinaryHeader:]
+	for i := 0; i < words; i++ {
+		order.PutUint64(data[8*i:], b.word(i))
+	}
+
+	crcAt := len(buf) - 4
+	binary.BigEndian.PutUint32(buf[crcAt:], crc32.ChecksumIEEE(buf[:crcAt]))
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a bitmap encoded by MarshalBinary, the data is copied.
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+	if len(data) < bitmapBinaryHeader+4 {
+		return fmt.Errorf("bitmap: binary data too short, length %d", len(data))
+	}
+	if data[0] != bitmapBinaryMagic[0] || data[1] != bitmapBinaryMagic[1] {
+		return fmt.Errorf("bitmap: binary data has bad magic %q", data[:2])
+	}
+	if data[2] != bitmapBinaryVersion {
+		return fmt.Errorf("bitmap: unsupported binary version %d", data[2])
+	}
+
+	crcAt := len(data) - 4
+	if crc := crc32.ChecksumIEEE(data[:crcAt]); crc != binary.BigEndian.Uint32(data[crcAt:]) {
+		return fmt.Errorf("bitmap: binary data checksum mismatch")
+	}
+
+	size := binary.BigEndian.Uint32(data[4:])
+	words := bitmapWords(size)
+	if crcAt-bitmapBinaryHeader != 8*words {
+		return fmt.Errorf("bitmap: binary data expected %d words for size %d, got %d bytes", words, size, crcAt-bitmapBinaryHeader)
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[3]&bitmapFlagBigEndian != 0 {
+		order = binary.BigEndian
+	}
+
+	out := NewBitmap(size)
+	payload := data[bitmapBinaryHeader:crcAt]
+	for i := 0; i < words; i++ {
+		out.bits[i] = order.Uint64(payload[8*i:])
+	}
+	*b = *out
+	return nil
+}
+
+// bitmapWords returns the number of words holding size bits.
+func bitmapWords(size uint32) int {
+	return int((uint64(size) + 63) / 64)
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// ConcurrentBitmap is a bitmap which is safe for concurrent use. Single bit
+// updates are done with atomic compare-and-swap on the words while holding the
+// read lock, so they never wait on each other. Growing the bitmap and the set
+// operations take the write lock.
+type ConcurrentBitmap struct {
+	lock   sync.RWMutex
+	bitmap Bitmap
+}
+
+func NewConcurrentBitmap(size uint32) *ConcurrentBitmap {
+	c := &ConcurrentBitmap{}
+	c.bitmap.Grow(size)
+	return c
+}
+
+// TestAndSet sets the bit x and returns its previous value, the bitmap grows if
+// necessary. Bits start at 1, setting bit 0 does nothing and returns false.
+func (c *ConcurrentBitmap) TestAndSet(x uint32) bool {
+	if x == 0 {
+		return false
+	}
+	c.lock.RLock()
+	if x <= c.bitmap.size {
+		old := c.casBit(x, true)
+		c.lock.RUnlock()
+		return old
+	}
+	c.lock.RUnlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.bitmap.Contains(x)
+	c.bitmap.Set(x)
+	return old
+}
+
+// TestAndClear clears the bit x and returns its previous value.
+func (c *ConcurrentBitmap) TestAndClear(x uint32) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if x == 0 || x > c.bitmap.size {
+		return false
+	}
+	return c.casBit(x, false)
+}
+
+// AllocMinZero atomically sets the first zero bit and returns its index.
+func (c *ConcurrentBitmap) AllocMinZero() (uint32, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for blkAt := range c.bitmap.bits {
+		addr := &c.bitmap.bits[blkAt]
+		for {
+			blk := atomic.LoadUint64(addr)
+			if blk == 0xffffffffffffffff {
+				break
+			}
+			bitAt := bits.LeadingZeros64(^blk)
+			x := uint32(blkAt<<6 + bitAt + 1)
+			if x > c.bitmap.size {
+				return 0, false
+			}
+			if atomic.CompareAndSwapUint64(addr, blk, blk|mask(bitAt)) {
+				return x, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Set sets the bit x in the bitmap and grows it if necessary.
+func (c *ConcurrentBitmap) Set(x uint32) {
+	c.TestAndSet(x)
+}
+
+// Remove removes the bit x from the bitmap, but does not shrink it.
+func (c *ConcurrentBitmap) Remove(x uint32) {
+	c.TestAndClear(x)
+}
+
+// Contains checks whether a value is contained in the bitmap or not.
+func (c *ConcurrentBitmap) Contains(x uint32) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if x == 0 || x > c.bitmap.size {
+		return false
+	}
+	blkAt, bitAt := loc(x)
+	return atomic.LoadUint64(&c.bitmap.bits[blkAt])&mask(bitAt) != 0
+}
+
+// Count returns the number of elements in this bitmap
+func (c *ConcurrentBitmap) Count() int {
+	return c.Snapshot().Count()
+}
+
+// Size returns the number of bits in this bitmap
+func (c *ConcurrentBitmap) Size() uint32 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bitmap.size
+}
+
+// Snapshot returns a copy of the bitmap which is not affected by later updates.
+func (c *ConcurrentBitmap) Snapshot() *Bitmap {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	out := &Bitmap{size: c.bitmap.size, bits: make([]uint64, len(c.bitmap.bits))}
+	for i := range c.bitmap.bits {
+		out.bits[i] = atomic.LoadUint64(&c.bitmap.bits[i])
+	}
+	return out
+}
+
+// Grow grows the bitmap size until we reach the desired bit.
+func (c *ConcurrentBitmap) Grow(desiredBit uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bitmap.Grow(desiredBit)
+}
+
+// Clear clears the bitmap and resizes it to zero.
+func (c *ConcurrentBitmap) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bitmap.Clear()
+}
+
+// And computes the intersection between two bitmaps and stores the result in the current bitmap
+func (c *ConcurrentBitmap) And(other Bitmap, extra ...Bitmap) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bitmap.And(other, extra...)
+}
+
+// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
+func (c *ConcurrentBitmap) AndNot(other Bitmap, extra ...Bitmap) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bitmap.AndNot(other, extra...)
+}
+
+// Or computes the union between two bitmaps and stores the result in the current bitmap
+func (c *ConcurrentBitmap) Or(other Bitmap, extra ...Bitmap) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bitmap.Or(other, extra...)
+}
+
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap
+func (c *ConcurrentBitmap) Xor(other Bitmap, extra ...Bitmap) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bitmap.Xor(other, extra...)
+}
+
+// casBit sets or clears the bit x with compare-and-swap and returns its
+// previous value, the caller holds the read lock and checked x is in range.
+func (c *ConcurrentBitmap) casBit(x uint32, set bool) bool {
+	blkAt, bitAt := loc(x)
+	addr := &c.bitmap.bits[blkAt]
+	m := mask(bitAt)
+	for {
+		blk := atomic.LoadUint64(addr)
+		next := blk &^ m
+		if set {
+			next = blk | m
+		}
+		if next == blk || atomic.CompareAndSwapUint64(addr, blk, next) {
+			return blk&m != 0
+		}
+	}
+}
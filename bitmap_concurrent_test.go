@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrentBitmapTestAndSet(t *testing.T) {
+	const workers, size = 8, 1000
+	c := NewConcurrentBitmap(size)
+
+	wins := make([]int, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for x := uint32(1); x <= size; x++ {
+				if !c.TestAndSet(x) {
+					wins[w]++
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range wins {
+		total += n
+	}
+	if total != size {
+		t.Fatalf("bits set first %d times, want %d", total, size)
+	}
+	if n := c.Count(); n != size {
+		t.Fatalf("count %d, want %d", n, size)
+	}
+}
+
+func TestConcurrentBitmapTestAndClear(t *testing.T) {
+	const workers, size = 8, 1000
+	c := NewConcurrentBitmap(size)
+	for x := uint32(1); x <= size; x++ {
+		c.Set(x)
+	}
+
+	var lock sync.Mutex
+	cleared := 0
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := 0
+			for x := uint32(1); x <= size; x++ {
+				if c.TestAndClear(x) {
+					n++
+				}
+			}
+			lock.Lock()
+			cleared += n
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if cleared != size {
+		t.Fatalf("bits cleared first %d times, want %d", cleared, size)
+	}
+	if n := c.Count(); n != 0 {
+		t.Fatalf("count %d, want 0", n)
+	}
+}
+
+func TestConcurrentBitmapAllocMinZero(t *testing.T) {
+	const workers, size = 8, 1000
+	c := NewConcurrentBitmap(size)
+
+	ids := make(chan uint32, size+workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				x, ok := c.AllocMinZero()
+				if !ok {
+					return
+				}
+				ids <- x
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[uint32]bool{}
+	for x := range ids {
+		if x == 0 || x > size {
+			t.Fatalf("allocated %d out of range", x)
+		}
+		if seen[x] {
+			t.Fatalf("allocated %d twice", x)
+		}
+		seen[x] = true
+	}
+	if len(seen) != size {
+		t.Fatalf("allocated %d ids, want %d", len(seen), size)
+	}
+}
+
+func TestConcurrentBitmapGrow(t *testing.T) {
+	const workers, size, allocs = 4, 4096, 500
+	c := NewConcurrentBitmap(64)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for s := uint32(128); s <= size; s += 64 {
+			c.Grow(s)
+		}
+	}()
+
+	ids := make(chan uint32, workers*allocs)
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for x := uint32(1); x <= 64; x++ {
+				c.TestAndSet(x)
+				c.TestAndClear(x)
+				c.TestAndSet(x)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < allocs; i++ {
+				if x, ok := c.AllocMinZero(); ok {
+					ids <- x
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	if s := c.Size(); s != size {
+		t.Fatalf("size %d, want %d", s, size)
+	}
+	for x := uint32(1); x <= 64; x++ {
+		if !c.Contains(x) {
+			t.Fatalf("bit %d is not set", x)
+		}
+	}
+	above := map[uint32]bool{}
+	for x := range ids {
+		if x > 64 {
+			if above[x] {
+				t.Fatalf("allocated %d twice", x)
+			}
+			above[x] = true
+		}
+	}
+	if n := c.Count(); n != 64+len(above) {
+		t.Fatalf("count %d, want %d", n, 64+len(above))
+	}
+}
+
+func TestConcurrentBitmapZero(t *testing.T) {
+	c := NewConcurrentBitmap(128)
+	if c.TestAndSet(0) {
+		t.Fatalf("bit 0 reported as set")
+	}
+	if c.Contains(64) || c.Count() != 0 {
+		t.Fatalf("setting bit 0 changed the bitmap")
+	}
+}
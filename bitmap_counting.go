@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// CountingBitmap keeps a reference count per bit, indexed from 1 like Bitmap.
+// The counters are packed 4 or 8 bits per slot, counts beyond the slot
+// maximum spill to a map.
+type CountingBitmap struct {
+	size     uint32
+	width    uint
+	slots    []uint64
+	overflow map[uint32]uint32
+}
+
+// NewCountingBitmap creates a counting bitmap with width bits per counter, which is 4 or 8.
+func NewCountingBitmap(size uint32, width int) *CountingBitmap {
+	if width != 4 && width != 8 {
+		panic(fmt.Sprintf("bitmap: counter width expected to be 4 or 8, was %d", width))
+	}
+	c := &CountingBitmap{
+		width:    uint(width),
+		overflow: map[uint32]uint32{},
+	}
+	c.Grow(size)
+	return c
+}
+
+// slotLoc returns the word of x and the shift of its counter in the word.
+func (c *CountingBitmap) slotLoc(x uint32) (int, uint) {
+	perWord := 64 / c.width
+	return int((x - 1) / uint32(perWord)), uint((x-1)%uint32(perWord)) * c.width
+}
+
+func (c *CountingBitmap) slotMax() uint64 {
+	return 1<<c.width - 1
+}
+
+// Set increments the count of x and grows the bitmap if necessary.
+func (c *CountingBitmap) Set(x uint32) {
+	if x == 0 {
+		return
+	}
+	if x > c.size {
+		c.Grow(x)
+	}
+
+	wordAt, shift := c.slotLoc(x)
+	if v := c.slots[wordAt] >> shift & c.slotMax(); v < c.slotMax() {
+		c.slots[wordAt] += 1 << shift
+	} else {
+		c.overflow[x]++
+	}
+}
+
+// Remove decrements the count of x, but does not shrink the bitmap.
+func (c *CountingBitmap) Remove(x uint32) {
+	if x == 0 || x > c.size {
+		return
+	}
+	if n, ok := c.overflow[x]; ok {
+		if n <= 1 {
+			delete(c.overflow, x)
+		} else {
+			c.overflow[x] = n - 1
+		}
+		return
+	}
+
+	wordAt, shift := c.slotLoc(x)
+	if c.slots[wordAt]>>shift&c.slotMax() > 0 {
+		c.slots[wordAt] -= 1 << shift
+	}
+}
+
+// Contains checks whether the count of x is greater than zero.
+func (c *CountingBitmap) Contains(x uint32) bool {
+	return c.CountOf(x) > 0
+}
+
+// CountOf returns the count of x.
+func (c *CountingBitmap) CountOf(x uint32) uint32 {
+	if x == 0 || x > c.size {
+		return 0
+	}
+	wordAt, shift := c.slotLoc(x)
+	return uint32(c.slots[wordAt]>>shift&c.slotMax()) + c.overflow[x]
+}
+
+// Count returns the number of values with a count greater than zero.
+func (c *CountingBitmap) Count() int {
+	sum := 0
+	for _, w := range c.slots {
+		sum += bits.OnesCount64(c.nonzero(w))
+	}
+	return sum
+}
+
+// Min get the smallest value with a count greater than zero.
+func (c *CountingBitmap) Min() (uint32, bool) {
+	for wordAt, w := range c.slots {
+		if f := c.nonzero(w); f != 0 {
+			return c.value(wordAt, bits.TrailingZeros64(f)), true
+		}
+	}
+	return 0, false
+}
+
+// Max get the largest value with a count greater than zero.
+func (c *CountingBitmap) Max() (uint32, bool) {
+	for wordAt := len(c.slots) - 1; wordAt >= 0; wordAt-- {
+		if f := c.nonzero(c.slots[wordAt]); f != 0 {
+			return c.value(wordAt, 63-bits.LeadingZeros64(f)), true
+		}
+	}
+	return 0, false
+}
+
+// MinZero finds the first value with a count of zero.
+func (c *CountingBitmap) MinZero() (uint32, bool) {
+	low := c.lowMask()
+	for wordAt, w := range c.slots {
+		if f := ^c.nonzero(w) & low; f != 0 {
+			if x := c.value(wordAt, bits.TrailingZeros64(f)); x <= c.size {
+				return x, true
+			}
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// Grow grows the bitmap size until we reach the desired bit. The counters
+// beyond the size are dropped when shrinking.
+func (c *CountingBitmap) Grow(desiredBit uint32) {
+	if desiredBit < c.size {
+		for x := desiredBit + 1; x <= c.size; x++ {
+			wordAt, shift := c.slotLoc(x)
+			c.slots[wordAt] &^= c.slotMax() << shift
+			delete(c.overflow, x)
+		}
+	}
+	c.size = desiredBit
+
+	words := int((uint64(desiredBit)*uint64(c.width) + 63) / 64)
+	if words > len(c.slots) {
+		c.slots = append(c.slots, make([]uint64, words-len(c.slots))...)
+	}
+}
+
+// Clear clears the bitmap and resizes it to zero.
+func (c *CountingBitmap) Clear() {
+	c.slots = c.slots[:0]
+	c.overflow = map[uint32]uint32{}
+	c.size = 0
+}
+
+// ToBitmap returns the bitmap of the values with a count greater than zero.
+func (c *CountingBitmap) ToBitmap() *Bitmap {
+	b := NewBitmap(c.size)
+	for wordAt, w := range c.slots {
+		for f := c.nonzero(w); f != 0; f &= f - 1 {
+			b.Set(c.value(wordAt, bits.TrailingZeros64(f)))
+		}
+	}
+	return b
+}
+
+// nonzero returns a word with the lowest bit of every nonzero slot set.
+func (c *CountingBitmap) nonzero(w uint64) uint64 {
+	for s := uint(1); s < c.width; s <<= 1 {
+		w |= w >> s
+	}
+	return w & c.lowMask()
+}
+
+// lowMask returns a word with the lowest bit of every slot set.
+func (c *CountingBitmap) lowMask() uint64 {
+	if c.width == 4 {
+		return 0x1111111111111111
+	}
+	return 0x0101010101010101
+}
+
+// value returns the value of the slot starting at bit bitAt of the word.
+func (c *CountingBitmap) value(wordAt int, bitAt int) uint32 {
+	return uint32(wordAt)*uint32(64/c.width) + uint32(uint(bitAt)/c.width) + 1
+}
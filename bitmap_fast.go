@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"container/heap"
+	"math/bits"
+)
+
+// fastBlockWords is the number of words combined for all of the inputs before
+// moving on, so the output block stays in cache while the inputs stream by.
+const fastBlockWords = 256
+
+// FastOr returns a new bitmap with the union of all of the bitmaps, sized to the largest one.
+func FastOr(bitmaps ...*Bitmap) *Bitmap {
+	var size uint32
+	for _, b := range bitmaps {
+		size = maxuint32(size, b.size)
+	}
+
+	out := NewBitmap(size)
+	words := bitmapWords(size)
+	for lo := 0; lo < words; lo += fastBlockWords {
+		dst := out.bits[lo:minint(lo+fastBlockWords, words)]
+		for _, b := range bitmaps {
+			src := fastSource(b, lo, len(dst))
+			for i, blk := range src {
+				dst[i] |= blk
+			}
+			if last := bitmapWords(b.size) - 1; last >= lo && last < lo+len(dst) {
+				dst[last-lo] |= b.word(last)
+			}
+		}
+	}
+	return out
+}
+
+// FastAnd returns a new bitmap with the intersection of all of the bitmaps, sized to the smallest one.
+func FastAnd(bitmaps ...*Bitmap) *Bitmap {
+	if len(bitmaps) == 0 {
+		return NewBitmap(0)
+	}
+	size := bitmaps[0].size
+	for _, b := range bitmaps[1:] {
+		size = minuint32(size, b.size)
+	}
+
+	out := NewBitmap(size)
+	words := bitmapWords(size)
+	for lo := 0; lo < words; lo += fastBlockWords {
+		dst := out.bits[lo:minint(lo+fastBlockWords, words)]
+		for i := range dst {
+			dst[i] = bitmaps[0].word(lo + i)
+		}
+		for _, b := range bitmaps[1:] {
+			src := fastSource(b, lo, len(dst))
+			for i, blk := range src {
+				dst[i] &= blk
+			}
+			// the words of b which are partial or missing in this block
+			for i := len(src); i < len(dst); i++ {
+				dst[i] &= b.word(lo + i)
+			}
+		}
+	}
+	return out
+}
+
+// fastSource returns the full words of b in the block starting at lo, the
+// last partial word of b is left out since its bits beyond size must be dropped.
+func fastSource(b *Bitmap, lo, n int) []uint64 {
+	full := minint(bitmapWords(b.size), len(b.bits))
+	if _, bitAt := loc(b.size); bitAt != 63 && full == bitmapWords(b.size) {
+		full--
+	}
+	if full <= lo {
+		return nil
+	}
+	return b.bits[lo:minint(lo+n, full)]
+}
+
+// FastOrRoaring returns a new compressed bitmap with the union of all of the
+// bitmaps. The chunks are merged in key order with a heap, so each chunk of
+// the output is built once from all of the inputs holding it.
+func FastOrRoaring(bitmaps ...*RoaringBitmap) *RoaringBitmap {
+	out := NewRoaringBitmap()
+	fastRoaring(bitmaps, func(key uint16, cs []container) {
+		var c container
+		if len(cs) == 1 {
+			c = cs[0].clone()
+		} else {
+			acc := &bitsetContainer{}
+			for _, x := range cs {
+				bx := x.toBitset()
+				for i := range acc.words {
+					acc.words[i] |= bx.words[i]
+				}
+			}
+			for _, w := range acc.words {
+				acc.card += bits.OnesCount64(w)
+			}
+			c = optimize(acc)
+		}
+		out.keys = append(out.keys, key)
+		out.containers = append(out.containers, c)
+	})
+	return out
+}
+
+// FastAndRoaring returns a new compressed bitmap with the intersection of all of the bitmaps.
+func FastAndRoaring(bitmaps ...*RoaringBitmap) *RoaringBitmap {
+	out := NewRoaringBitmap()
+	fastRoaring(bitmaps, func(key uint16, cs []container) {
+		if len(cs) != len(bitmaps) {
+			return
+		}
+		c := cs[0]
+		for _, x := range cs[1:] {
+			if c = andContainers(c, x); c == nil {
+				return
+			}
+		}
+		if c == cs[0] {
+			c = c.clone()
+		}
+		out.keys = append(out.keys, key)
+		out.containers = append(out.containers, c)
+	})
+	return out
+}
+
+// fastRoaring calls f in ascending key order with the containers of every
+// bitmap holding that key.
+func fastRoaring(bitmaps []*RoaringBitmap, f func(key uint16, cs []container)) {
+	h := &roaringHeap{}
+	for _, r := range bitmaps {
+		if len(r.keys) > 0 {
+			*h = append(*h, roaringCursor{bitmap: r})
+		}
+	}
+	heap.Init(h)
+
+	cs := make([]container, 0, len(bitmaps))
+	for h.Len() > 0 {
+		key := (*h)[0].key()
+		cs = cs[:0]
+		for h.Len() > 0 && (*h)[0].key() == key {
+			cur := &(*h)[0]
+			cs = append(cs, cur.bitmap.containers[cur.at])
+			if cur.at++; cur.at < len(cur.bitmap.keys) {
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+		}
+		f(key, cs)
+	}
+}
+
+// roaringCursor points to the next container of a bitmap to merge.
+type roaringCursor struct {
+	bitmap *RoaringBitmap
+	at     int
+}
+
+func (c *roaringCursor) key() uint16 {
+	return c.bitmap.keys[c.at]
+}
+
+// roaringHeap orders the cursors by their next key, implements heap.Interface
+type roaringHeap []roaringCursor
+
+func (h roaringHeap) Len() int           { return len(h) }
+func (h roaringHeap) Less(i, j int) bool { return h[i].key() < h[j].key() }
+func (h roaringHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *roaringHeap) Push(x interface{}) {
+	*h = append(*h, x.(roaringCursor))
+}
+
+func (h *roaringHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// inputs of the set operation benchmarks: 8 bitmaps of 2^22 bits with 1% set
+const (
+	benchBitmapSize  = 1 << 22
+	benchBitmapCount = 8
+	benchBitmapSet   = benchBitmapSize / 100
+)
+
+var (
+	benchBitmaps  []*Bitmap
+	benchRoarings []*RoaringBitmap
+)
+
+// benchInputs builds the inputs once and resets the timer.
+func benchInputs(b *testing.B) ([]*Bitmap, []*RoaringBitmap) {
+	if benchBitmaps == nil {
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < benchBitmapCount; i++ {
+			bm := NewBitmap(benchBitmapSize)
+			for n := 0; n < benchBitmapSet; n++ {
+				bm.Set(uint32(rnd.Int63n(benchBitmapSize)) + 1)
+			}
+			benchBitmaps = append(benchBitmaps, bm)
+			benchRoarings = append(benchRoarings, bm.ToRoaring())
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	return benchBitmaps, benchRoarings
+}
+
+// benchBitmapInputs returns the flat inputs and reports the bytes one
+// operation reads from them.
+func benchBitmapInputs(b *testing.B) []*Bitmap {
+	bitmaps, _ := benchInputs(b)
+	b.SetBytes(benchBitmapSize / 8 * benchBitmapCount)
+	return bitmaps
+}
+
+func benchValues(bitmaps []*Bitmap) []Bitmap {
+	out := make([]Bitmap, len(bitmaps))
+	for i, bm := range bitmaps {
+		out[i] = *bm
+	}
+	return out
+}
+
+func BenchmarkBitmapOrPairwise(b *testing.B) {
+	bitmaps := benchBitmapInputs(b)
+	for i := 0; i < b.N; i++ {
+		out := bitmaps[0].Clone()
+		for _, bm := range bitmaps[1:] {
+			out.Or(*bm)
+		}
+	}
+}
+
+func BenchmarkBitmapOrNWay(b *testing.B) {
+	bitmaps := benchBitmapInputs(b)
+	for i := 0; i < b.N; i++ {
+		out := bitmaps[0].Clone()
+		out.Or(*bitmaps[1], benchValues(bitmaps[2:])...)
+	}
+}
+
+func BenchmarkFastOr(b *testing.B) {
+	bitmaps := benchBitmapInputs(b)
+	for i := 0; i < b.N; i++ {
+		FastOr(bitmaps...)
+	}
+}
+
+func BenchmarkBitmapAndPairwise(b *testing.B) {
+	bitmaps := benchBitmapInputs(b)
+	for i := 0; i < b.N; i++ {
+		out := bitmaps[0].Clone()
+		for _, bm := range bitmaps[1:] {
+			out.And(*bm)
+		}
+	}
+}
+
+func BenchmarkBitmapAndNWay(b *testing.B) {
+	bitmaps := benchBitmapInputs(b)
+	for i := 0; i < b.N; i++ {
+		out := bitmaps[0].Clone()
+		out.And(*bitmaps[1], benchValues(bitmaps[2:])...)
+	}
+}
+
+func BenchmarkFastAnd(b *testing.B) {
+	bitmaps := benchBitmapInputs(b)
+	for i := 0; i < b.N; i++ {
+		FastAnd(bitmaps...)
+	}
+}
+
+func BenchmarkRoaringOrPairwise(b *testing.B) {
+	_, roarings := benchInputs(b)
+	for i := 0; i < b.N; i++ {
+		out := NewRoaringBitmap()
+		for _, r := range roarings {
+			out.Or(*r)
+		}
+	}
+}
+
+func BenchmarkFastOrRoaring(b *testing.B) {
+	_, roarings := benchInputs(b)
+	for i := 0; i < b.N; i++ {
+		FastOrRoaring(roarings...)
+	}
+}
+
+func BenchmarkRoaringAndPairwise(b *testing.B) {
+	_, roarings := benchInputs(b)
+	for i := 0; i < b.N; i++ {
+		out := NewRoaringBitmap()
+		out.Or(*roarings[0])
+		for _, r := range roarings[1:] {
+			out.And(*r)
+		}
+	}
+}
+
+func BenchmarkFastAndRoaring(b *testing.B) {
+	_, roarings := benchInputs(b)
+	for i := 0; i < b.N; i++ {
+		FastAndRoaring(roarings...)
+	}
+}
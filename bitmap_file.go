@@ -0,0 +1,415 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	fileBitmapOpSet    byte = 'S'
+	fileBitmapOpRemove byte = 'R'
+	fileBitmapOpGrow   byte = 'G'
+
+	// fileBitmapRecordLen is op (1) + value (4) + crc32 (4)
+	fileBitmapRecordLen = 9
+
+	// fileBitmapHeaderLen is magic (2) + version (1) + reserved (1) +
+	// generation (8) + crc32 (4)
+	fileBitmapHeaderLen     = 16
+	fileBitmapHeaderVersion = 1
+
+	// DefaultFileBitmapCompactRecords is the number of log records after which
+	// the log is folded into a new snapshot.
+	DefaultFileBitmapCompactRecords int = 4096
+)
+
+var (
+	fileBitmapSnapshotMagic = [2]byte{'F', 'S'}
+	fileBitmapLogMagic      = [2]byte{'F', 'L'}
+)
+
+// FileBitmap is a bitmap persisted on disk, which survives process crashes.
+// The state is kept as a snapshot file in the bitmap binary format written
+// with write-rename, plus an append-only log next to it ("<path>.log") where
+// every update is fsync'd before it is applied. Opening the bitmap loads the
+// snapshot and replays the log, stopping at the first torn record.
+//
+// Both files start with a header carrying the generation of the snapshot,
+// which every compaction increments. A log of an older generation than the
+// snapshot was left by a crash during compaction and is skipped, since its
+// records are already in the snapshot.
+type FileBitmap struct {
+	Path           string
+	CompactRecords int
+	lock           sync.Mutex
+	bitmap         *Bitmap
+	generation     uint64
+	log            *os.File
+	records        int
+}
+
+// OpenFileBitmap opens or creates the bitmap at path, size is used when the
+// bitmap is created and grows an existing one if it is larger.
+func OpenFileBitmap(path string, size uint32) (*FileBitmap, error) {
+	f := &FileBitmap{
+		Path:           path,
+		CompactRecords: DefaultFileBitmapCompactRecords,
+	}
+
+	b, generation, err := readBitmapSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	f.bitmap, f.generation = b, generation
+
+	log, err := os.OpenFile(path+".log", os.O_RDWR|os.O_CREATE, MODE_PERM_RW)
+	if err != nil {
+		return nil, err
+	}
+	f.log = log
+
+	if err := f.replay(); err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	if size > f.bitmap.size {
+		if err := f.Grow(size); err != nil {
+			log.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Set sets the bit x in the bitmap and grows it if necessary.
+func (f *FileBitmap) Set(x uint32) error {
+	return f.update(fileBitmapOpSet, x)
+}
+
+// Remove removes the bit x from the bitmap, but does not shrink it.
+func (f *FileBitmap) Remove(x uint32) error {
+	return f.update(fileBitmapOpRemove, x)
+}
+
+// Grow grows the bitmap size until we reach the desired bit.
+func (f *FileBitmap) Grow(desiredBit uint32) error {
+	return f.update(fileBitmapOpGrow, desiredBit)
+}
+
+// AllocMinZero sets the first zero bit and returns its index once it is persisted.
+func (f *FileBitmap) AllocMinZero() (uint32, bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	x, ok := f.bitmap.MinZero()
+	if !ok {
+		return 0, false, nil
+	}
+	if err := f.updateLocked(fileBitmapOpSet, x); err != nil {
+		return 0, false, err
+	}
+	return x, true, nil
+}
+
+// Contains checks whether a value is contained in the bitmap or not.
+func (f *FileBitmap) Contains(x uint32) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.bitmap.Contains(x)
+}
+
+// MinZero finds the first zero bit and returns its index.
+func (f *FileBitmap) MinZero() (uint32, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.bitmap.MinZero()
+}
+
+// Count returns the number of elements in this bitmap
+func (f *FileBitmap) Count() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.bitmap.Count()
+}
+
+// Bitmap returns a copy of the in-memory bitmap.
+func (f *FileBitmap) Bitmap() *Bitmap {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.bitmap.Clone()
+}
+
+// Compact writes a new snapshot and truncates the log.
+func (f *FileBitmap) Compact() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.compactLocked()
+}
+
+// Close compacts the log and closes the files.
+func (f *FileBitmap) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.log == nil {
+		return nil
+	}
+	err := f.compactLocked()
+	if f.log == nil {
+		// compactLocked closed the log after failing to reset it
+		return err
+	}
+	if err1 := f.log.Close(); err == nil {
+		err = err1
+	}
+	f.log = nil
+	return err
+}
+
+func (f *FileBitmap) update(op byte, x uint32) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.updateLocked(op, x)
+}
+
+// updateLocked appends the record to the log and syncs it before applying it
+// in memory. A failed append is cut off the log, so the bitmap is unchanged
+// and the next record starts at a record boundary.
+func (f *FileBitmap) updateLocked(op byte, x uint32) error {
+	if f.log == nil {
+		return fmt.Errorf("file bitmap '%s' is closed", f.Path)
+	}
+
+	offset, err := f.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = f.log.Write(encodeFileBitmapRecord(op, x))
+	if err == nil {
+		err = f.log.Sync()
+	}
+	if err != nil {
+		f.rollbackLocked(offset)
+		return err
+	}
+
+	applyFileBitmapOp(f.bitmap, op, x)
+	f.records++
+	if f.CompactRecords > 0 && f.records >= f.CompactRecords {
+		// the update is already durable, a failed compaction is retried later
+		if err := f.compactLocked(); err != nil {
+			LogPrintf(LOG_WARN, "FileBitmap", "compact '%s' failed: %s", f.Path, err.Error())
+		}
+	}
+	return nil
+}
+
+// rollbackLocked truncates the log to offset after a failed append. If that
+// fails too the log is closed, since appending after a partial record would
+// make replay drop every later update.
+func (f *FileBitmap) rollbackLocked(offset int64) {
+	err := f.log.Truncate(offset)
+	if err == nil {
+		_, err = f.log.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		err = f.log.Sync()
+	}
+	if err != nil {
+		LogPrintf(LOG_ERROR, "FileBitmap", "rollback log '%s.log' failed, closing it: %s", f.Path, err.Error())
+		f.log.Close()
+		f.log = nil
+	}
+}
+
+// replay applies the log on top of the snapshot. A short or corrupted record
+// means the process crashed while writing it, so the log is truncated there.
+func (f *FileBitmap) replay() error {
+	data, err := ioutil.ReadAll(f.log)
+	if err != nil {
+		return err
+	}
+	if len(data) < fileBitmapHeaderLen {
+		// a new log, or the process crashed while resetting it after
+		// writing the snapshot
+		return f.resetLogLocked()
+	}
+	generation, err := decodeFileBitmapHeader(data, fileBitmapLogMagic)
+	if err != nil {
+		return fmt.Errorf("file bitmap log '%s.log' is corrupted: %s", f.Path, err.Error())
+	}
+	switch {
+	case generation < f.generation:
+		LogPrintf(LOG_WARN, "FileBitmap", "skip log '%s.log' of generation %d, the snapshot has generation %d", f.Path, generation, f.generation)
+		return f.resetLogLocked()
+	case generation > f.generation:
+		return fmt.Errorf("file bitmap log '%s.log' has generation %d, newer than the snapshot generation %d", f.Path, generation, f.generation)
+	}
+
+	valid := fileBitmapHeaderLen
+	for ; valid+fileBitmapRecordLen <= len(data); valid += fileBitmapRecordLen {
+		rec := data[valid : valid+fileBitmapRecordLen]
+		if crc32.ChecksumIEEE(rec[:5]) != binary.BigEndian.Uint32(rec[5:]) {
+			break
+		}
+		applyFileBitmapOp(f.bitmap, rec[0], binary.BigEndian.Uint32(rec[1:5]))
+		f.records++
+	}
+
+	if valid < len(data) {
+		LogPrintf(LOG_WARN, "FileBitmap", "truncate torn log '%s.log' at %d", f.Path, valid)
+		if err := f.log.Truncate(int64(valid)); err != nil {
+			return err
+		}
+	}
+	_, err = f.log.Seek(int64(valid), io.SeekStart)
+	return err
+}
+
+// compactLocked writes the current bitmap as the snapshot of the next
+// generation and starts an empty log of that generation. A crash between the
+// two leaves the log of the previous generation, which is skipped on open. If
+// the log cannot be reset it is closed, since records appended to it would be
+// skipped as well.
+func (f *FileBitmap) compactLocked() error {
+	generation := f.generation + 1
+	if err := writeBitmapSnapshot(f.Path, generation, f.bitmap); err != nil {
+		return err
+	}
+	f.generation = generation
+	if err := f.resetLogLocked(); err != nil {
+		LogPrintf(LOG_ERROR, "FileBitmap", "reset log '%s.log' failed, closing it: %s", f.Path, err.Error())
+		f.log.Close()
+		f.log = nil
+		return err
+	}
+	return nil
+}
+
+// resetLogLocked empties the log and writes the header of the current generation.
+func (f *FileBitmap) resetLogLocked() error {
+	if err := f.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.log.Write(encodeFileBitmapHeader(fileBitmapLogMagic, f.generation)); err != nil {
+		return err
+	}
+	f.records = 0
+	return f.log.Sync()
+}
+
+func applyFileBitmapOp(b *Bitmap, op byte, x uint32) {
+	switch op {
+	case fileBitmapOpSet:
+		b.Set(x)
+	case fileBitmapOpRemove:
+		b.Remove(x)
+	case fileBitmapOpGrow:
+		b.Grow(x)
+	}
+}
+
+// readBitmapSnapshot reads the snapshot and its generation, the bitmap
+// follows the header in the bitmap binary format.
+func readBitmapSnapshot(path string) (*Bitmap, uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return NewBitmap(0), 0, nil
+	case err != nil:
+		return nil, 0, err
+	}
+
+	generation, err := decodeFileBitmapHeader(data, fileBitmapSnapshotMagic)
+	if err != nil {
+		return nil, 0, fmt.Errorf("file bitmap '%s' is corrupted: %s", path, err.Error())
+	}
+	b := &Bitmap{}
+	if err := b.UnmarshalBinary(data[fileBitmapHeaderLen:]); err != nil {
+		return nil, 0, fmt.Errorf("file bitmap '%s' is corrupted: %s", path, err.Error())
+	}
+	return b, generation, nil
+}
+
+// writeBitmapSnapshot writes the snapshot to a temporary file, syncs it and
+// renames it over the previous one.
+func writeBitmapSnapshot(path string, generation uint64, b *Bitmap) error {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	data = append(encodeFileBitmapHeader(fileBitmapSnapshotMagic, generation), data...)
+
+	tmp := path + ".tmp"
+	t, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, MODE_PERM_RW)
+	if err != nil {
+		return err
+	}
+	if _, err := t.Write(data); err != nil {
+		t.Close()
+		return err
+	}
+	if err := t.Sync(); err != nil {
+		t.Close()
+		return err
+	}
+	if err := t.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// sync the directory so the rename itself is durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// encodeFileBitmapRecord returns the log record of an update.
+func encodeFileBitmapRecord(op byte, x uint32) []byte {
+	rec := make([]byte, fileBitmapRecordLen)
+	rec[0] = op
+	binary.BigEndian.PutUint32(rec[1:5], x)
+	binary.BigEndian.PutUint32(rec[5:], crc32.ChecksumIEEE(rec[:5]))
+	return rec
+}
+
+// encodeFileBitmapHeader returns the header of a snapshot or log file.
+func encodeFileBitmapHeader(magic [2]byte, generation uint64) []byte {
+	h := make([]byte, fileBitmapHeaderLen)
+	copy(h, magic[:])
+	h[2] = fileBitmapHeaderVersion
+	binary.BigEndian.PutUint64(h[4:12], generation)
+	binary.BigEndian.PutUint32(h[12:], crc32.ChecksumIEEE(h[:12]))
+	return h
+}
+
+// decodeFileBitmapHeader checks the header of a snapshot or log file and
+// returns its generation.
+func decodeFileBitmapHeader(data []byte, magic [2]byte) (uint64, error) {
+	if len(data) < fileBitmapHeaderLen {
+		return 0, fmt.Errorf("header is truncated, length %d", len(data))
+	}
+	if data[0] != magic[0] || data[1] != magic[1] {
+		return 0, fmt.Errorf("header has bad magic %q", data[:2])
+	}
+	if data[2] != fileBitmapHeaderVersion {
+		return 0, fmt.Errorf("unsupported header version %d", data[2])
+	}
+	if crc32.ChecksumIEEE(data[:12]) != binary.BigEndian.Uint32(data[12:16]) {
+		return 0, fmt.Errorf("header checksum mismatch")
+	}
+	return binary.BigEndian.Uint64(data[4:12]), nil
+}
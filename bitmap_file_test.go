@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashFileBitmap closes the log without compacting it, like a process crash.
+func crashFileBitmap(f *FileBitmap) {
+	f.log.Close()
+	f.log = nil
+}
+
+func openFileBitmap(t *testing.T, path string, size uint32) *FileBitmap {
+	f, err := OpenFileBitmap(path, size)
+	if err != nil {
+		t.Fatalf("open: %s", err.Error())
+	}
+	return f
+}
+
+func checkFileBitmap(t *testing.T, f *FileBitmap, want ...uint32) {
+	for _, x := range want {
+		if !f.Contains(x) {
+			t.Fatalf("bit %d is not set", x)
+		}
+	}
+	if n := f.Count(); n != len(want) {
+		t.Fatalf("count %d, want %d", n, len(want))
+	}
+}
+
+func TestFileBitmapReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmap")
+	f := openFileBitmap(t, path, 100)
+	for _, x := range []uint32{5, 70} {
+		if err := f.Set(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Remove(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Grow(200); err != nil {
+		t.Fatal(err)
+	}
+	if x, ok, err := f.AllocMinZero(); err != nil || !ok || x != 1 {
+		t.Fatalf("allocated %d, %v, %v", x, ok, err)
+	}
+	crashFileBitmap(f)
+
+	f = openFileBitmap(t, path, 0)
+	checkFileBitmap(t, f, 1, 70)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(path + ".log"); err != nil || st.Size() != fileBitmapHeaderLen {
+		t.Fatalf("log not compacted on close: %v, %v", st, err)
+	}
+
+	f = openFileBitmap(t, path, 0)
+	defer f.Close()
+	checkFileBitmap(t, f, 1, 70)
+	if f.bitmap.size != 200 {
+		t.Fatalf("size %d, want 200", f.bitmap.size)
+	}
+}
+
+func TestFileBitmapTornLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmap")
+	f := openFileBitmap(t, path, 64)
+	for x := uint32(1); x <= 10; x++ {
+		if err := f.Set(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crashFileBitmap(f)
+
+	// the process crashed in the middle of a record
+	log, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write(encodeFileBitmapRecord(fileBitmapOpSet, 20)[:5])
+	log.Close()
+
+	f = openFileBitmap(t, path, 0)
+	checkFileBitmap(t, f, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	if err := f.Set(11); err != nil {
+		t.Fatal(err)
+	}
+	crashFileBitmap(f)
+
+	f = openFileBitmap(t, path, 0)
+	defer f.Close()
+	checkFileBitmap(t, f, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+}
+
+func TestFileBitmapCrashDuringCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmap")
+	f := openFileBitmap(t, path, 64)
+	for _, x := range []uint32{1, 2} {
+		if err := f.Set(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale, err := ioutil.ReadFile(path + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a record the snapshot does not have shows whether the stale log is replayed
+	stale = append(stale, encodeFileBitmapRecord(fileBitmapOpSet, 3)...)
+
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	crashFileBitmap(f)
+	// the process crashed after writing the snapshot, before resetting the log
+	if err := ioutil.WriteFile(path+".log", stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f = openFileBitmap(t, path, 0)
+	checkFileBitmap(t, f, 1, 2)
+	if err := f.Set(4); err != nil {
+		t.Fatal(err)
+	}
+	crashFileBitmap(f)
+
+	f = openFileBitmap(t, path, 0)
+	defer f.Close()
+	checkFileBitmap(t, f, 1, 2, 4)
+}
+
+func TestFileBitmapCrashResettingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmap")
+	f := openFileBitmap(t, path, 64)
+	if err := f.Set(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	crashFileBitmap(f)
+	// the process crashed while writing the header of the new log
+	if err := os.Truncate(path+".log", fileBitmapHeaderLen/2); err != nil {
+		t.Fatal(err)
+	}
+
+	f = openFileBitmap(t, path, 0)
+	checkFileBitmap(t, f, 1)
+	if err := f.Set(2); err != nil {
+		t.Fatal(err)
+	}
+	crashFileBitmap(f)
+
+	f = openFileBitmap(t, path, 0)
+	defer f.Close()
+	checkFileBitmap(t, f, 1, 2)
+}
+
+func TestFileBitmapCorruptedSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmap")
+	f := openFileBitmap(t, path, 64)
+	if err := f.Set(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[fileBitmapHeaderLen+8] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileBitmap(path, 0); err == nil {
+		t.Fatalf("corrupted snapshot opened")
+	}
+}
@@ -0,0 +1,131 @@
+package utils
+
+import "math/bits"
+
+// BitmapIterator walks the set bits of a bitmap in ascending order, skipping
+// whole zero words. It can be reused for another bitmap with Reset.
+type BitmapIterator struct {
+	bitmap *Bitmap
+	blkAt  int
+	blk    uint64
+}
+
+// Iterator returns an iterator positioned at the first bit of the bitmap.
+func (b *Bitmap) Iterator() *BitmapIterator {
+	it := &BitmapIterator{}
+	it.Reset(b)
+	return it
+}
+
+// Reset points the iterator to the first bit of the given bitmap.
+func (it *BitmapIterator) Reset(b *Bitmap) {
+	it.bitmap = b
+	it.Seek(1)
+}
+
+// Seek moves the iterator so the next call to Next returns the first set bit
+// which is greater than or equal to from.
+func (it *BitmapIterator) Seek(from uint32) {
+	if from == 0 {
+		from = 1
+	}
+	blkAt, bitAt := loc(from)
+	if from > it.bitmap.size || blkAt >= len(it.bitmap.bits) {
+		it.blkAt, it.blk = len(it.bitmap.bits), 0
+		return
+	}
+	it.blkAt = blkAt
+	it.blk = it.bitmap.bits[blkAt] & (0xffffffffffffffff >> bitAt)
+}
+
+// Next returns the next set bit, or false when the iteration is over.
+func (it *BitmapIterator) Next() (uint32, bool) {
+	for it.blk == 0 {
+		if it.blkAt+1 >= len(it.bitmap.bits) {
+			it.blkAt = len(it.bitmap.bits)
+			return 0, false
+		}
+		it.blkAt++
+		it.blk = it.bitmap.bits[it.blkAt]
+	}
+
+	bitAt := bits.LeadingZeros64(it.blk)
+	it.blk &^= mask(bitAt)
+	if x := uint64(it.blkAt)<<6 + uint64(bitAt) + 1; x <= uint64(it.bitmap.size) {
+		return uint32(x), true
+	}
+
+	it.blkAt, it.blk = len(it.bitmap.bits), 0
+	return 0, false
+}
+
+// ForEach calls f for every set bit in ascending order until f returns false.
+func (b *Bitmap) ForEach(f func(x uint32) bool) {
+	b.ForEachRange(1, b.size, f)
+}
+
+// ForEachRange calls f for every set bit between lo and hi inclusive in
+// ascending order until f returns false.
+func (b *Bitmap) ForEachRange(lo, hi uint32, f func(x uint32) bool) {
+	it := BitmapIterator{bitmap: b}
+	it.Seek(lo)
+	for x, ok := it.Next(); ok && x <= hi; x, ok = it.Next() {
+		if !f(x) {
+			return
+		}
+	}
+}
+
+// NextSet finds the first set bit which is greater than or equal to from.
+func (b *Bitmap) NextSet(from uint32) (uint32, bool) {
+	it := BitmapIterator{bitmap: b}
+	it.Seek(from)
+	return it.Next()
+}
+
+// NextClear finds the first zero bit which is greater than or equal to from.
+func (b *Bitmap) NextClear(from uint32) (uint32, bool) {
+	if from == 0 {
+		from = 1
+	}
+	if from > b.size {
+		return 0, false
+	}
+
+	blkAt, bitAt := loc(from)
+	blk := ^b.bits[blkAt] & (0xffffffffffffffff >> bitAt)
+	for {
+		if blk != 0 {
+			if x := uint64(blkAt)<<6 + uint64(bits.LeadingZeros64(blk)) + 1; x <= uint64(b.size) {
+				return uint32(x), true
+			}
+			return 0, false
+		}
+		if blkAt++; blkAt >= len(b.bits) {
+			return 0, false
+		}
+		blk = ^b.bits[blkAt]
+	}
+}
+
+// PrevSet finds the last set bit which is less than or equal to from.
+func (b *Bitmap) PrevSet(from uint32) (uint32, bool) {
+	if from > b.size {
+		from = b.size
+	}
+	if from == 0 {
+		return 0, false
+	}
+
+	blkAt, bitAt := loc(from)
+	blk := b.bits[blkAt] &^ (0xffffffffffffffff >> (bitAt + 1))
+	for {
+		if blk != 0 {
+			return uint32(blkAt<<6 + 64 - bits.TrailingZeros64(blk)), true
+		}
+		if blkAt--; blkAt < 0 {
+			return 0, false
+		}
+		blk = b.bits[blkAt]
+	}
+}
@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+)
+
+// BitmapPatch holds the changes between two versions of a bitmap, so replicas
+// can be updated without sending the whole bitmap. A patch only applies to a
+// bitmap at the Base version with the BaseSum checksum, which then moves to
+// Version. Versions are local counters and unrelated bitmaps can share them,
+// the checksum rejects a patch built on other contents.
+type BitmapPatch struct {
+	Base    uint64        `json:"base"`
+	BaseSum uint64        `json:"base_sum"`
+	Version uint64        `json:"version"`
+	Size    uint32        `json:"size"`
+	Set     []BitmapRange `json:"set,omitempty"`
+	Cleared []BitmapRange `json:"cleared,omitempty"`
+}
+
+// BitmapRange is the range of bits from Lo to Hi inclusive.
+type BitmapRange struct {
+	Lo uint32 `json:"lo"`
+	Hi uint32 `json:"hi"`
+}
+
+// Version returns the version of the bitmap, which changes on every mutation.
+func (b *Bitmap) Version() uint64 {
+	return b.version
+}
+
+// SetVersion sets the version of the bitmap, used to seed a replica which
+// received the whole bitmap.
+func (b *Bitmap) SetVersion(version uint64) {
+	b.version = version
+}
+
+// Checksum returns the FNV-1a hash of the size and the bits of the bitmap.
+func (b *Bitmap) Checksum() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], b.size)
+	h.Write(buf[:4])
+	for i := 0; i < bitmapWords(b.size); i++ {
+		binary.BigEndian.PutUint64(buf[:], b.word(i))
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+// Diff returns the patch which turns old into new.
+func Diff(old, new *Bitmap) *BitmapPatch {
+	p := &BitmapPatch{
+		Base:    old.version,
+		BaseSum: old.Checksum(),
+		Version: new.version,
+		Size:    new.size,
+	}
+	new.Difference(old).setRuns(func(lo, hi uint32) {
+		p.Set = append(p.Set, BitmapRange{Lo: lo, Hi: hi})
+	})
+	old.Difference(new).setRuns(func(lo, hi uint32) {
+		// bits beyond the new size are dropped by the size itself
+		if lo <= new.size {
+			p.Cleared = append(p.Cleared, BitmapRange{Lo: lo, Hi: minuint32(hi, new.size)})
+		}
+	})
+	return p
+}
+
+// Apply applies the patch, it is rejected if the bitmap is not at the base
+// version of the patch or its contents differ from the base.
+func (b *Bitmap) Apply(p *BitmapPatch) error {
+	if b.version != p.Base {
+		return fmt.Errorf("bitmap: patch base version %d does not match version %d", p.Base, b.version)
+	}
+	if sum := b.Checksum(); sum != p.BaseSum {
+		return fmt.Errorf("bitmap: patch base checksum %x does not match checksum %x", p.BaseSum, sum)
+	}
+
+	b.Grow(p.Size)
+	for _, r := range p.Cleared {
+		b.ClearRange(r.Lo, r.Hi)
+	}
+	for _, r := range p.Set {
+		b.SetRange(r.Lo, r.Hi)
+	}
+	b.version = p.Version
+	return nil
+}
+
+// Binary format of a patch, the integers are uvarints unless noted:
+//
+//	magic   [2]byte  "BP"
+//	version uint8    bitmapPatchBinaryVersion
+//	base
+//	base sum uint64  big-endian
+//	version, size
+//	count of set ranges, then for every range
+//	  lo - previous hi, hi - lo
+//	count of cleared ranges, then the ranges as above
+//	crc     uint32   IEEE CRC-32 of everything before it, big-endian
+const bitmapPatchBinaryVersion uint8 = 2
+
+var bitmapPatchBinaryMagic = [2]byte{'B', 'P'}
+
+// MarshalBinary encodes the patch with delta encoded ranges.
+func (p *BitmapPatch) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 3, 3+3*binary.MaxVarintLen64+8+2*binary.MaxVarintLen32*(1+len(p.Set)+len(p.Cleared))+4)
+	copy(buf, bitmapPatchBinaryMagic[:])
+	buf[2] = bitmapPatchBinaryVersion
+
+	var tmp [binary.MaxVarintLen64]byte
+	put := func(v uint64) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+	put(p.Base)
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], p.BaseSum)
+	buf = append(buf, sum[:]...)
+	put(p.Version)
+	put(uint64(p.Size))
+	for _, ranges := range [][]BitmapRange{p.Set, p.Cleared} {
+		put(uint64(len(ranges)))
+		var prev uint32
+		for _, r := range ranges {
+			put(uint64(r.Lo - prev))
+			put(uint64(r.Hi - r.Lo))
+			prev = r.Hi
+		}
+	}
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(buf))
+	return append(buf, crc[:]...), nil
+}
+
+// UnmarshalBinary decodes a patch encoded by MarshalBinary.
+func (p *BitmapPatch) UnmarshalBinary(data []byte) error {
+	if len(data) < 7 {
+		return fmt.Errorf("bitmap: patch data too short, length %d", len(data))
+	}
+	if data[0] != bitmapPatchBinaryMagic[0] || data[1] != bitmapPatchBinaryMagic[1] {
+		return fmt.Errorf("bitmap: patch data has bad magic %q", data[:2])
+	}
+	if data[2] != bitmapPatchBinaryVersion {
+		return fmt.Errorf("bitmap: unsupported patch version %d", data[2])
+	}
+
+	crcAt := len(data) - 4
+	if crc := crc32.ChecksumIEEE(data[:crcAt]); crc != binary.BigEndian.Uint32(data[crcAt:]) {
+		return fmt.Errorf("bitmap: patch data checksum mismatch")
+	}
+
+	body := data[3:crcAt]
+	var err error
+	get := func() uint64 {
+		v, n := binary.Uvarint(body)
+		if n <= 0 {
+			if err == nil {
+				err = fmt.Errorf("bitmap: patch data is truncated")
+			}
+			return 0
+		}
+		body = body[n:]
+		return v
+	}
+	get32 := func() uint32 {
+		v := get()
+		if v > 0xffffffff && err == nil {
+			err = fmt.Errorf("bitmap: patch value %d overflows uint32", v)
+		}
+		return uint32(v)
+	}
+
+	out := BitmapPatch{Base: get()}
+	if len(body) < 8 {
+		return fmt.Errorf("bitmap: patch data is truncated")
+	}
+	out.BaseSum = binary.BigEndian.Uint64(body)
+	body = body[8:]
+	out.Version, out.Size = get(), get32()
+	for _, ranges := range []*[]BitmapRange{&out.Set, &out.Cleared} {
+		n := get()
+		if n > uint64(len(body)) {
+			return fmt.Errorf("bitmap: patch data is truncated")
+		}
+		var prev uint64
+		for i := uint64(0); i < n && err == nil; i++ {
+			lo := prev + get()
+			hi := lo + get()
+			if hi > 0xffffffff {
+				return fmt.Errorf("bitmap: patch range %d-%d overflows uint32", lo, hi)
+			}
+			*ranges = append(*ranges, BitmapRange{Lo: uint32(lo), Hi: uint32(hi)})
+			prev = hi
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(body) != 0 {
+		return fmt.Errorf("bitmap: patch data has %d trailing bytes", len(body))
+	}
+
+	*p = out
+	return nil
+}
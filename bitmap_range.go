@@ -0,0 +1,154 @@
+package utils
+
+// RunStrategy selects which free run FindClearRun returns.
+type RunStrategy int
+
+const (
+	// FirstFit returns the lowest run which is large enough.
+	FirstFit RunStrategy = iota
+	// BestFit returns the smallest run which is large enough.
+	BestFit
+	// NextFit returns the first run which is large enough after the previous
+	// next fit result, wrapping around at the end of the bitmap.
+	NextFit
+)
+
+// FindClearRun finds n contiguous zero bits and returns the index of the first
+// one. It does not set the bits, use SetRange to allocate them.
+func (b *Bitmap) FindClearRun(n uint32, strategy RunStrategy) (uint32, bool) {
+	if n == 0 || n > b.size {
+		return 0, false
+	}
+
+	switch strategy {
+	case BestFit:
+		var best, bestLen uint32
+		b.clearRuns(1, func(start, length uint32) bool {
+			if length >= n && (bestLen == 0 || length < bestLen) {
+				best, bestLen = start, length
+			}
+			return bestLen != n
+		})
+		return best, bestLen > 0
+	case NextFit:
+		start, ok := b.firstFit(b.cursor, n)
+		if !ok && b.cursor > 1 {
+			start, ok = b.firstFit(1, n)
+		}
+		if ok {
+			b.cursor = start + n
+		}
+		return start, ok
+	default:
+		return b.firstFit(1, n)
+	}
+}
+
+// SetRange sets the bits from lo to hi inclusive and grows the bitmap if necessary.
+func (b *Bitmap) SetRange(lo, hi uint32) {
+	if lo == 0 {
+		lo = 1
+	}
+	if lo > hi {
+		return
+	}
+	b.changed()
+	if hi > b.size {
+		blkAt, _ := loc(hi)
+		b.grow(blkAt)
+		b.resize(hi)
+	}
+
+	b.applyRange(lo, hi, func(blkAt int, m uint64) {
+		b.bits[blkAt] |= m
+	})
+}
+
+// ClearRange clears the bits from lo to hi inclusive, but does not shrink the bitmap.
+func (b *Bitmap) ClearRange(lo, hi uint32) {
+	if lo == 0 {
+		lo = 1
+	}
+	if hi > b.size {
+		hi = b.size
+	}
+	if lo > hi {
+		return
+	}
+
+	b.changed()
+	b.applyRange(lo, hi, func(blkAt int, m uint64) {
+		b.bits[blkAt] &^= m
+	})
+}
+
+// applyRange calls f with the mask of the bits between lo and hi for every
+// block they cover.
+func (b *Bitmap) applyRange(lo, hi uint32, f func(blkAt int, m uint64)) {
+	blkLo, bitLo := loc(lo)
+	blkHi, bitHi := loc(hi)
+	head := uint64(0xffffffffffffffff) >> bitLo
+	tail := ^(uint64(0xffffffffffffffff) >> (bitHi + 1))
+
+	if blkLo == blkHi {
+		f(blkLo, head&tail)
+		return
+	}
+
+	f(blkLo, head)
+	for blkAt := blkLo + 1; blkAt < blkHi; blkAt++ {
+		f(blkAt, 0xffffffffffffffff)
+	}
+	f(blkHi, tail)
+}
+
+// firstFit finds the first run of n zero bits starting at or after from.
+func (b *Bitmap) firstFit(from, n uint32) (found uint32, ok bool) {
+	b.clearRuns(from, func(start, length uint32) bool {
+		if length >= n {
+			found, ok = start, true
+		}
+		return !ok
+	})
+	return
+}
+
+// clearRuns calls f with the start and length of every run of zero bits
+// starting at or after from, until f returns false.
+func (b *Bitmap) clearRuns(from uint32, f func(start, length uint32) bool) {
+	for from <= b.size {
+		start, ok := b.NextClear(from)
+		if !ok {
+			return
+		}
+		end, ok := b.NextSet(start)
+		if !ok {
+			f(start, b.size-start+1)
+			return
+		}
+		if !f(start, end-start) {
+			return
+		}
+		from = end
+	}
+}
+
+// setRuns calls f with the first and last index of every run of set bits
+// in ascending order.
+func (b *Bitmap) setRuns(f func(lo, hi uint32)) {
+	for from := uint32(1); from <= b.size; {
+		lo, ok := b.NextSet(from)
+		if !ok {
+			return
+		}
+		hi := b.size
+		if end, ok := b.NextClear(lo); ok {
+			hi = end - 1
+		}
+		f(lo, hi)
+		if hi == b.size {
+			return
+		}
+		from = hi + 1
+	}
+}
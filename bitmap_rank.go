@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// rankBlockWords is the number of words covered by one entry of the rank index.
+const rankBlockWords = 8
+
+// rankIndex holds the popcount of the words before every rank block of the
+// bitmap it was built for.
+type rankIndex struct {
+	owner  *Bitmap
+	counts []int
+}
+
+// Rank returns the number of set bits which are less than or equal to x. It
+// takes constant time after BuildRankIndex and linear time otherwise.
+func (b *Bitmap) Rank(x uint32) int {
+	if x > b.size {
+		x = b.size
+	}
+	if x == 0 || len(b.bits) == 0 {
+		return 0
+	}
+
+	blkAt, bitAt := loc(x)
+	return b.countBefore(blkAt) + bits.OnesCount64(b.bits[blkAt]>>(63-uint64(bitAt)))
+}
+
+// CountRange returns the number of set bits between lo and hi inclusive.
+func (b *Bitmap) CountRange(lo, hi uint32) int {
+	if lo == 0 {
+		lo = 1
+	}
+	if lo > hi {
+		return 0
+	}
+	return b.Rank(hi) - b.Rank(lo-1)
+}
+
+// Select returns the k-th set bit, counting from 1. It takes logarithmic time
+// after BuildRankIndex and linear time otherwise.
+func (b *Bitmap) Select(k int) (uint32, bool) {
+	if k <= 0 || len(b.bits) == 0 {
+		return 0, false
+	}
+
+	start := 0
+	if counts := b.rankCounts(); counts != nil {
+		// last rank block which starts with less than k bits before it
+		rankAt := sort.Search(len(counts), func(i int) bool { return counts[i] >= k }) - 1
+		if rankAt >= len(counts)-1 {
+			return 0, false
+		}
+		k -= counts[rankAt]
+		start = rankAt * rankBlockWords
+	}
+
+	for blkAt := start; blkAt < len(b.bits); blkAt++ {
+		blk := b.bits[blkAt]
+		if n := bits.OnesCount64(blk); n < k {
+			k -= n
+			continue
+		}
+		for ; k > 1; k-- {
+			blk &^= mask(bits.LeadingZeros64(blk))
+		}
+		if x := uint64(blkAt)<<6 + uint64(bits.LeadingZeros64(blk)) + 1; x <= uint64(b.size) {
+			return uint32(x), true
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// BuildRankIndex computes the popcount of the words before every rank block,
+// which speeds up Rank, CountRange and Select until the next mutation drops
+// it. It writes the bitmap, so it needs the same synchronization as Set.
+// Copies of the bitmap do not use its index.
+func (b *Bitmap) BuildRankIndex() {
+	if b.rankCounts() != nil {
+		return
+	}
+
+	blocks := (len(b.bits) + rankBlockWords - 1) / rankBlockWords
+	counts := make([]int, blocks+1)
+	for i := 0; i < blocks; i++ {
+		end := minint((i+1)*rankBlockWords, len(b.bits))
+		counts[i+1] = counts[i] + count(b.bits[i*rankBlockWords:end])
+	}
+	b.index = &rankIndex{owner: b, counts: counts}
+}
+
+// rankCounts returns the rank index, or nil if there is none. The index of a
+// bitmap copied by value belongs to the original, so it is ignored.
+func (b *Bitmap) rankCounts() []int {
+	if b.index == nil || b.index.owner != b {
+		return nil
+	}
+	return b.index.counts
+}
+
+// countBefore returns the number of set bits in the words before blkAt.
+func (b *Bitmap) countBefore(blkAt int) int {
+	counts := b.rankCounts()
+	if counts == nil {
+		return count(b.bits[:blkAt])
+	}
+	rankAt := blkAt / rankBlockWords
+	return counts[rankAt] + count(b.bits[rankAt*rankBlockWords:blkAt])
+}
+
+// invalidate drops the rank index, it has to be called whenever the words change.
+func (b *Bitmap) invalidate() {
+	b.index = nil
+}
+
+// changed invalidates the bitmap and bumps the version, every public mutation
+// calls it exactly once.
+func (b *Bitmap) changed() {
+	b.invalidate()
+	b.version++
+}
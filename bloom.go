@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter is a probabilistic set stored in a Bitmap, Test may return false
+// positives but never false negatives.
+type BloomFilter struct {
+	bitmap *Bitmap
+	k      uint32
+}
+
+type bloomFilterJSON struct {
+	K      uint32     `json:"k"`
+	Bitmap *HexBitmap `json:"bitmap"`
+}
+
+// NewBloomFilter sizes the filter for the expected number of items and false positive rate.
+func NewBloomFilter(expected uint, fpRate float64) *BloomFilter {
+	m, k := bloomSize(expected, fpRate)
+	return NewBloomFilterWith(m, k)
+}
+
+// NewBloomFilterWith creates a filter of m bits and k hashes.
+func NewBloomFilterWith(m uint32, k uint32) *BloomFilter {
+	if m == 0 {
+		m = 1
+	}
+	if k == 0 {
+		k = 1
+	}
+	return &BloomFilter{bitmap: NewBitmap(m), k: k}
+}
+
+// Add adds the data to the filter.
+func (f *BloomFilter) Add(data []byte) {
+	bloomLocations(data, f.k, f.bitmap.size, func(x uint32) bool {
+		f.bitmap.Set(x)
+		return true
+	})
+}
+
+// AddString adds the string to the filter.
+func (f *BloomFilter) AddString(s string) {
+	f.Add([]byte(s))
+}
+
+// Test checks whether the data may have been added to the filter.
+func (f *BloomFilter) Test(data []byte) bool {
+	found := true
+	bloomLocations(data, f.k, f.bitmap.size, func(x uint32) bool {
+		found = f.bitmap.Contains(x)
+		return found
+	})
+	return found
+}
+
+// TestString checks whether the string may have been added to the filter.
+func (f *BloomFilter) TestString(s string) bool {
+	return f.Test([]byte(s))
+}
+
+// Union adds the items of the other filter, both need the same size and number of hashes.
+func (f *BloomFilter) Union(other *BloomFilter) error {
+	if f.bitmap.size != other.bitmap.size || f.k != other.k {
+		return fmt.Errorf("bloom filter %d bits/%d hashes does not match %d bits/%d hashes",
+			f.bitmap.size, f.k, other.bitmap.size, other.k)
+	}
+	f.bitmap.Or(*other.bitmap)
+	return nil
+}
+
+// EstimatedCount estimates the number of distinct items added to the filter.
+func (f *BloomFilter) EstimatedCount() uint {
+	return bloomEstimate(f.bitmap.Count(), f.bitmap.size, f.k)
+}
+
+// Clear removes all the items from the filter.
+func (f *BloomFilter) Clear() {
+	f.bitmap = NewBitmap(f.bitmap.size)
+}
+
+func (f *BloomFilter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bloomFilterJSON{K: f.k, Bitmap: f.bitmap.ToHexBitmap()})
+}
+
+func (f *BloomFilter) UnmarshalJSON(data []byte) error {
+	in := bloomFilterJSON{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.K == 0 || in.Bitmap == nil || in.Bitmap.Size == 0 {
+		return fmt.Errorf("bloom filter has no hashes or bits")
+	}
+	b, err := in.Bitmap.ToBitmap()
+	if err != nil {
+		return err
+	}
+	f.bitmap, f.k = b, in.K
+	return nil
+}
+
+// CountingBloomFilter is a Bloom filter on a CountingBitmap, which also supports Remove.
+type CountingBloomFilter struct {
+	counters *CountingBitmap
+	k        uint32
+}
+
+// NewCountingBloomFilter sizes the filter for the expected number of items and false positive rate.
+func NewCountingBloomFilter(expected uint, fpRate float64) *CountingBloomFilter {
+	m, k := bloomSize(expected, fpRate)
+	return &CountingBloomFilter{counters: NewCountingBitmap(m, 4), k: k}
+}
+
+// Add adds the data to the filter.
+func (f *CountingBloomFilter) Add(data []byte) {
+	bloomLocations(data, f.k, f.counters.size, func(x uint32) bool {
+		f.counters.Set(x)
+		return true
+	})
+}
+
+// Remove removes data which was added before, removing data which was never
+// added corrupts the filter.
+func (f *CountingBloomFilter) Remove(data []byte) {
+	if !f.Test(data) {
+		return
+	}
+	bloomLocations(data, f.k, f.counters.size, func(x uint32) bool {
+		f.counters.Remove(x)
+		return true
+	})
+}
+
+// Test checks whether the data may have been added to the filter.
+func (f *CountingBloomFilter) Test(data []byte) bool {
+	found := true
+	bloomLocations(data, f.k, f.counters.size, func(x uint32) bool {
+		found = f.counters.Contains(x)
+		return found
+	})
+	return found
+}
+
+// EstimatedCount estimates the number of distinct items in the filter.
+func (f *CountingBloomFilter) EstimatedCount() uint {
+	return bloomEstimate(f.counters.Count(), f.counters.size, f.k)
+}
+
+// ToBloomFilter returns the plain Bloom filter with the same items.
+func (f *CountingBloomFilter) ToBloomFilter() *BloomFilter {
+	return &BloomFilter{bitmap: f.counters.ToBitmap(), k: f.k}
+}
+
+// bloomSize returns the number of bits m and hashes k for n items at false positive rate p:
+// m = -n ln(p) / ln(2)^2, k = m/n ln(2)
+func bloomSize(n uint, p float64) (uint32, uint32) {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	if m > math.MaxUint32 {
+		m = math.MaxUint32
+	}
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return uint32(m), uint32(k)
+}
+
+// bloomEstimate estimates the number of items from the number of set bits x:
+// n = -m/k ln(1 - x/m)
+func bloomEstimate(x int, m uint32, k uint32) uint {
+	if uint32(x) >= m {
+		return uint(float64(m) / float64(k))
+	}
+	return uint(math.Round(-float64(m) / float64(k) * math.Log(1-float64(x)/float64(m))))
+}
+
+// bloomLocations calls f with the k bits of data in 1..m until f returns false.
+// The bits come from double hashing the two halves of the 64-bit FNV-1a hash.
+func bloomLocations(data []byte, k uint32, m uint32, f func(x uint32) bool) {
+	h := fnv.New64a()
+	h.Write(data)
+	sum := h.Sum64()
+	h1, h2 := uint64(uint32(sum)), sum>>32|1
+	for i := uint64(0); i < uint64(k); i++ {
+		if !f(uint32((h1+i*h2)%uint64(m)) + 1) {
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flexlet/utils"
+)
+
+func main() {
+	var (
+		bindAddr string
+		port     int
+	)
+	flag.StringVar(&bindAddr, "addr", "127.0.0.1", "Bind address of both nodes")
+	flag.IntVar(&port, "port", 7946, "Port of the first node, the second node uses port+1")
+	flag.Parse()
+	TestRequest(bindAddr, port)
+}
+
+func TestRequest(bindAddr string, port int) {
+	received := make(chan string, 1)
+	a := utils.GossipWith("node-a", bindAddr, port)
+	a.NotifyMsgHandler = func(msg []byte) {
+		received <- string(msg)
+	}
+	a.RequestHandler = func(from string, req []byte) ([]byte, error) {
+		if string(req) == "fail" {
+			return nil, fmt.Errorf("failed on purpose")
+		}
+		return []byte(strings.ToUpper(string(req))), nil
+	}
+
+	b := utils.GossipWith("node-b", bindAddr, port+1)
+	// node-b has no RequestHandler, requests to it fail with an error response
+
+	if err := a.Start(nil); err != nil {
+		panic(err)
+	}
+	defer a.Shutdown()
+	members := fmt.Sprintf("%s:%d", bindAddr, port)
+	if err := b.Start(&members); err != nil {
+		panic(err)
+	}
+	defer b.Shutdown()
+
+	ctx := context.Background()
+
+	println("b.Request node-a")
+	resp, err := b.Request(ctx, "node-a", []byte("hello"))
+	check(err == nil && string(resp) == "HELLO", "response '%s', error %v", resp, err)
+
+	println("b.Request node-a with error")
+	_, err = b.Request(ctx, "node-a", []byte("fail"))
+	check(err != nil && err.Error() == "failed on purpose", "error %v", err)
+
+	println("a.Request node-b without handler")
+	_, err = a.Request(ctx, "node-b", []byte("hello"))
+	check(err != nil, "request to a node without handler succeeded")
+
+	println("b.Request unknown node")
+	_, err = b.Request(ctx, "node-c", []byte("hello"))
+	check(err != nil, "request to an unknown node succeeded")
+
+	println("b.Request node-a with timeout")
+	a.RequestHandler = func(from string, req []byte) ([]byte, error) {
+		time.Sleep(time.Second)
+		return req, nil
+	}
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	_, err = b.Request(tctx, "node-a", []byte("slow"))
+	cancel()
+	check(err != nil, "request did not time out")
+
+	println("b.SendTo node-a")
+	check(b.SendTo("node-a", []byte("direct")) == nil, "send failed")
+	select {
+	case msg := <-received:
+		check(msg == "direct", "received '%s'", msg)
+	case <-time.After(5 * time.Second):
+		check(false, "message not received")
+	}
+
+	println("ok")
+}
+
+func check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		panic(fmt.Sprintf(format, args...))
+	}
+}
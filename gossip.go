@@ -1,14 +1,20 @@
 package utils
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/hashicorp/memberlist"
 )
 
+// gossipDrainInterval is the interval of checking the broadcast queue while leaving
+const gossipDrainInterval = 100 * time.Millisecond
+
 type Gossip struct {
 	Name                    string
 	BindAddr                string
@@ -17,7 +23,12 @@ type Gossip struct {
 	ProbeInterval           int
 	SyncInterval            int
 	RetransmitMult          int
-	Ready                   bool
+	Ready                   bool // Deprecated: read without synchronization, use IsReady or State
+	Codec                   GossipCodec
+	RequestTimeout          int
+	KeyRotationInterval     int
+	MetricsInterval         int
+	Metrics                 MetricsSink
 	NotifyJoinHandler       func(*memberlist.Node)
 	NotifyLeaveHandler      func(*memberlist.Node)
 	NotifyUpdateHandler     func(*memberlist.Node)
@@ -26,71 +37,294 @@ type Gossip struct {
 	NotifyMsgHandler        func([]byte)
 	LocalStateHandler       func() []byte
 	MergeRemoteStateHandler func([]byte)
+	RequestHandler          func(from string, req []byte) ([]byte, error)
+	NotifyMetaHandler       func(name string, meta NodeMeta)
 	queue                   *memberlist.TransmitLimitedQueue
 	members                 *memberlist.Memberlist
+	lock                    sync.Mutex
+	state                   GossipState
+	done                    chan struct{}
+	meta                    []byte
+	keyring                 *memberlist.Keyring
+	rotation                *keyRotation
+	nodes                   map[string]gossipNode
+	topics                  map[string]func(*GossipMessage)
+	seq                     uint64
+	requests                map[uint64]gossipRequest
+	requestID               uint64
+	sent                    uint64
+	received                uint64
+	merges                  uint64
+}
+
+// GossipState is the lifecycle state of a gossip
+type GossipState int
+
+const (
+	GossipStateNew GossipState = iota
+	GossipStateStarting
+	GossipStateReady
+	GossipStateLeaving
+	GossipStateStopping
+	GossipStateStopped
+)
+
+func (s GossipState) String() string {
+	switch s {
+	case GossipStateNew:
+		return "new"
+	case GossipStateStarting:
+		return "starting"
+	case GossipStateReady:
+		return "ready"
+	case GossipStateLeaving:
+		return "leaving"
+	case GossipStateStopping:
+		return "stopping"
+	case GossipStateStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("GossipState(%d)", int(s))
 }
 
 // Start gossip
 func (g *Gossip) Start(members *string) error {
+	return g.StartContext(context.Background(), members)
+}
+
+// Start gossip, joining the members is abandoned when ctx is done. A stopped
+// gossip can be started again.
+func (g *Gossip) StartContext(ctx context.Context, members *string) error {
 	c := memberlist.DefaultLocalConfig()
 
 	c.Name = g.Name
 	c.BindAddr = g.BindAddr
 	c.BindPort = g.BindPort
-	c.SecretKey = g.SecretKey
 	c.ProbeInterval = time.Duration(g.ProbeInterval) * time.Second
 	c.PushPullInterval = time.Duration(g.SyncInterval) * time.Second
 	c.RetransmitMult = g.RetransmitMult
 	c.Events = &event_delegate_impl{
 		gossip: g,
 	}
+
+	g.lock.Lock()
+	encrypted := g.keyring != nil || len(g.SecretKey) > 0
+	g.lock.Unlock()
+	if encrypted {
+		kr, err := g.ring(false)
+		if err != nil {
+			return err
+		}
+		c.Keyring = kr
+	}
+	g.Subscribe(keyringTopic, g.handleKeyringMsg)
+
+	g.lock.Lock()
+	if g.state != GossipStateNew && g.state != GossipStateStopped {
+		g.lock.Unlock()
+		return fmt.Errorf("gossip is %s", g.state)
+	}
+	if g.state == GossipStateStopped {
+		g.done = nil
+	}
+	g.setStateLocked(GossipStateStarting)
+	g.queue = &memberlist.TransmitLimitedQueue{
+		NumNodes: func() int {
+			if ml := g.list(); ml != nil {
+				return ml.NumMembers()
+			}
+			return 1
+		},
+		RetransmitMult: c.RetransmitMult,
+	}
+	// the delegate keeps its own queue, g.queue is replaced by a restart
 	c.Delegate = &delegate_impl{
 		gossip: g,
+		queue:  g.queue,
 	}
+	g.lock.Unlock()
 
-	if ml, err := memberlist.Create(c); err != nil {
+	ml, err := memberlist.Create(c)
+	if err != nil {
+		g.setState(GossipStateStopped)
 		return err
-	} else {
-		g.members = ml
 	}
+	g.lock.Lock()
+	g.members = ml
+	g.lock.Unlock()
 
 	if members != nil && len(*members) > 0 {
 		parts := strings.Split(*members, ",")
-		_, err := g.members.Join(parts)
+		joined := make(chan error, 1)
+		go func() {
+			_, err := ml.Join(parts)
+			joined <- err
+		}()
+		select {
+		case err = <-joined:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
 		if err != nil {
+			ml.Shutdown()
+			g.setState(GossipStateStopped)
 			return err
 		}
 	}
 
-	g.queue = &memberlist.TransmitLimitedQueue{
-		NumNodes: func() int {
-			return g.members.NumMembers()
-		},
-		RetransmitMult: c.RetransmitMult,
-	}
-
-	local := g.members.LocalNode()
+	local := ml.LocalNode()
 	LogPrintf(LOG_DEBUG, "gossip", "local member %s:%d", local.Addr, local.Port)
 
-	g.Ready = true
+	g.setState(GossipStateReady)
+	g.reportMetrics()
 	return nil
 }
 
+// Leave waits up to timeout for the queued broadcasts to be sent, then
+// broadcasts the leave of the local node and waits up to timeout for it to be
+// sent. The gossip still has to be shut down.
+func (g *Gossip) Leave(timeout time.Duration) error {
+	g.lock.Lock()
+	if g.state != GossipStateReady {
+		state := g.state
+		g.lock.Unlock()
+		return fmt.Errorf("gossip is %s", state)
+	}
+	g.setStateLocked(GossipStateLeaving)
+	ml, queue := g.members, g.queue
+	g.lock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for queue.NumQueued() > 0 && ml.NumMembers() > 1 && time.Now().Before(deadline) {
+		time.Sleep(gossipDrainInterval)
+	}
+	if n := queue.NumQueued(); n > 0 {
+		LogPrintf(LOG_WARN, "gossip", "leave with %d broadcasts queued", n)
+	}
+	return ml.Leave(timeout)
+}
+
+// Shutdown stops the gossip without notifying the other nodes, unless Leave
+// was called before. The queued broadcasts are dropped.
+func (g *Gossip) Shutdown() error {
+	g.lock.Lock()
+	if g.state != GossipStateReady && g.state != GossipStateLeaving {
+		state := g.state
+		g.lock.Unlock()
+		return fmt.Errorf("gossip is %s", state)
+	}
+	g.setStateLocked(GossipStateStopping)
+	ml, queue := g.members, g.queue
+	g.lock.Unlock()
+
+	err := ml.Shutdown()
+	queue.Reset()
+	g.lock.Lock()
+	g.nodes = nil
+	g.lock.Unlock()
+	g.setState(GossipStateStopped)
+	return err
+}
+
+// State returns the lifecycle state
+func (g *Gossip) State() GossipState {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.state
+}
+
+// IsReady checks whether the gossip has started and is not leaving
+func (g *Gossip) IsReady() bool {
+	return g.State() == GossipStateReady
+}
+
+// Done returns a channel which is closed when the gossip stops
+func (g *Gossip) Done() <-chan struct{} {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.done == nil {
+		g.done = make(chan struct{})
+	}
+	return g.done
+}
+
+func (g *Gossip) setState(state GossipState) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.setStateLocked(state)
+}
+
+// setStateLocked sets the state with the lock held, and closes done once the
+// gossip is stopped.
+func (g *Gossip) setStateLocked(state GossipState) {
+	g.state = state
+	g.Ready = state == GossipStateReady
+	if state != GossipStateStopped {
+		return
+	}
+	if g.done == nil {
+		g.done = make(chan struct{})
+	}
+	select {
+	case <-g.done:
+	default:
+		close(g.done)
+	}
+}
+
+// list returns the memberlist, nil if not started
+func (g *Gossip) list() *memberlist.Memberlist {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.members
+}
+
 // Broadcast message
 func (g *Gossip) Broadcast(msg []byte) {
-	if !g.Ready || g.queue == nil {
+	g.queueBroadcast("", msg, nil)
+}
+
+// Broadcast message, the returned channel is closed when memberlist has
+// finished retransmitting it, or it was replaced or dropped
+func (g *Gossip) BroadcastWithNotify(msg []byte) <-chan struct{} {
+	notify := make(chan struct{})
+	g.queueBroadcast("", msg, notify)
+	return notify
+}
+
+// Broadcast message for a key, it replaces the queued message of the same key.
+// Keyed messages are not passed to InvalidatesHandler.
+func (g *Gossip) BroadcastKeyed(key string, msg []byte) {
+	g.queueBroadcast(key, msg, nil)
+}
+
+func (g *Gossip) queueBroadcast(key string, msg []byte, notify chan struct{}) {
+	g.lock.Lock()
+	queue := g.queue
+	ready := g.state == GossipStateReady
+	g.lock.Unlock()
+	if !ready {
 		LogPrintf(LOG_DEBUG, "gossip", "not ready")
+		if notify != nil {
+			close(notify)
+		}
 		return
 	}
-	g.queue.QueueBroadcast(&broadcast_impl{
+	b := &broadcast_impl{
 		msg:    msg,
-		notify: nil,
+		notify: notify,
 		gossip: g,
-	})
+	}
+	if key != "" {
+		queue.QueueBroadcast(&keyed_broadcast_impl{broadcast_impl: *b, key: key})
+	} else {
+		queue.QueueBroadcast(b)
+	}
+	g.countSent("broadcast")
 }
 
 // Generage a default broadcast, need to set handlers:
-//   - NotifyMsgHandler
+//   - NotifyMsgHandler, or Subscribe to topics
 //   - LocalStateHandler
 //   - MergeRemoteStateHandler
 func DefaultGossip() *Gossip {
@@ -104,7 +338,9 @@ func GossipWith(name string, bindAddr string, bindPort int) *Gossip {
 	g.BindAddr = bindAddr
 	g.BindPort = bindPort
 	g.RetransmitMult = 0
-	g.Ready = false
+	g.RequestTimeout = defaultRequestTimeout
+	g.KeyRotationInterval = defaultKeyRotationInterval
+	g.MetricsInterval = defaultMetricsInterval
 	g.NodeMetaHandler = defaultNodeMetaHandler
 	g.NotifyJoinHandler = defaultNotifyJoinHandler
 	g.NotifyLeaveHandler = defaultNotifyLeaveHandler
@@ -141,26 +377,49 @@ func defaultInvalidatesHandler(other memberlist.Broadcast) bool {
 // Implatementation of memberlist.Delegate
 type delegate_impl struct {
 	gossip *Gossip
+	queue  *memberlist.TransmitLimitedQueue
 }
 
 func (d *delegate_impl) NodeMeta(limit int) []byte {
-	return d.gossip.NodeMetaHandler()
+	d.gossip.lock.Lock()
+	meta := d.gossip.meta
+	d.gossip.lock.Unlock()
+	if meta == nil && d.gossip.NodeMetaHandler != nil {
+		meta = d.gossip.NodeMetaHandler()
+	}
+	if len(meta) > limit {
+		LogPrintf(LOG_WARN, "gossip", "drop node meta of %d bytes, limit is %d", len(meta), limit)
+		return nil
+	}
+	return meta
 }
 
 func (d *delegate_impl) NotifyMsg(b []byte) {
-	d.gossip.NotifyMsgHandler(b)
+	d.gossip.countReceived()
+	if d.gossip.dispatch(b) {
+		return
+	}
+	if d.gossip.NotifyMsgHandler != nil {
+		d.gossip.NotifyMsgHandler(b)
+	}
 }
 
 func (d *delegate_impl) GetBroadcasts(overhead, limit int) [][]byte {
-	return d.gossip.queue.GetBroadcasts(overhead, limit)
+	return d.queue.GetBroadcasts(overhead, limit)
 }
 
 func (d *delegate_impl) LocalState(join bool) []byte {
+	if d.gossip.LocalStateHandler == nil {
+		return nil
+	}
 	return d.gossip.LocalStateHandler()
 }
 
 func (d *delegate_impl) MergeRemoteState(buf []byte, join bool) {
-	d.gossip.MergeRemoteStateHandler(buf)
+	d.gossip.countMerge()
+	if d.gossip.MergeRemoteStateHandler != nil {
+		d.gossip.MergeRemoteStateHandler(buf)
+	}
 }
 
 // Implementation of memberlist.EventDelegate
@@ -169,14 +428,17 @@ type event_delegate_impl struct {
 }
 
 func (ed *event_delegate_impl) NotifyJoin(node *memberlist.Node) {
+	ed.gossip.trackNode(node, false)
 	ed.gossip.NotifyJoinHandler(node)
 }
 
 func (ed *event_delegate_impl) NotifyLeave(node *memberlist.Node) {
+	ed.gossip.trackNode(node, true)
 	ed.gossip.NotifyLeaveHandler(node)
 }
 
 func (ed *event_delegate_impl) NotifyUpdate(node *memberlist.Node) {
+	ed.gossip.trackNode(node, false)
 	ed.gossip.NotifyUpdateHandler(node)
 }
 
@@ -188,6 +450,9 @@ type broadcast_impl struct {
 }
 
 func (b *broadcast_impl) Invalidates(other memberlist.Broadcast) bool {
+	if b.gossip.InvalidatesHandler == nil {
+		return false
+	}
 	return b.gossip.InvalidatesHandler(other)
 }
 
@@ -200,3 +465,19 @@ func (b *broadcast_impl) Finished() {
 		close(b.notify)
 	}
 }
+
+// Implementation of memberlist.NamedBroadcast, the queue replaces the queued
+// broadcast of the same key by name instead of scanning with Invalidates
+type keyed_broadcast_impl struct {
+	broadcast_impl
+	key string
+}
+
+func (b *keyed_broadcast_impl) Name() string {
+	return b.key
+}
+
+func (b *keyed_broadcast_impl) Invalidates(other memberlist.Broadcast) bool {
+	nb, ok := other.(memberlist.NamedBroadcast)
+	return ok && nb.Name() == b.key
+}
@@ -0,0 +1,448 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CRDT is a state which converges when merged with the states of other nodes
+// in any order.
+type CRDT interface {
+	// State returns the full state of the CRDT
+	State() ([]byte, error)
+	// Merge merges a full or partial state received from another node
+	Merge(state []byte) error
+}
+
+// CRDTStore replicates named CRDTs over a Gossip. It takes over the
+// LocalStateHandler and MergeRemoteStateHandler of the gossip for the full
+// state sync, and subscribes to crdtTopic for the updates broadcast by other
+// nodes. Create the store before starting the gossip.
+type CRDTStore struct {
+	gossip  *Gossip
+	process string // suffix of the node name keying the counter entries of this process
+	lock    sync.Mutex
+	crdts   map[string]CRDT
+	pending map[string][][]byte
+}
+
+// crdtTopic is the topic of the CRDT updates
+const crdtTopic = "utils.crdt"
+
+// crdtMaxPending is the number of states kept per CRDT which is not created
+// locally yet, the oldest are dropped first
+const crdtMaxPending = 256
+
+type crdtMsg struct {
+	Name  string          `json:"name"`
+	State json.RawMessage `json:"state"`
+}
+
+func NewCRDTStore(g *Gossip) *CRDTStore {
+	s := &CRDTStore{
+		gossip:  g,
+		process: uuid.New().String(),
+		crdts:   map[string]CRDT{},
+		pending: map[string][][]byte{},
+	}
+
+	g.Subscribe(crdtTopic, func(msg *GossipMessage) {
+		m := crdtMsg{}
+		if err := msg.Decode(&m); err != nil {
+			LogPrintf(LOG_WARN, "gossip", "decode crdt update failed: %s", err.Error())
+			return
+		}
+		s.merge(m.Name, m.State)
+	})
+	g.LocalStateHandler = s.localState
+	g.MergeRemoteStateHandler = s.mergeRemoteState
+	return s
+}
+
+// LWWMap returns the last-writer-wins map with the given name, creating it if needed.
+func (s *CRDTStore) LWWMap(name string) (*LWWMap, error) {
+	c, err := s.getOrCreate(name, func() CRDT {
+		return &LWWMap{store: s, name: name, entries: map[string]lwwEntry{}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := c.(*LWWMap); ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("crdt '%s' is not a lww map", name)
+}
+
+// ORSet returns the observed-remove set with the given name, creating it if needed.
+func (s *CRDTStore) ORSet(name string) (*ORSet, error) {
+	c, err := s.getOrCreate(name, func() CRDT {
+		return &ORSet{store: s, name: name, adds: map[string]map[string]bool{}, removes: map[string]bool{}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if o, ok := c.(*ORSet); ok {
+		return o, nil
+	}
+	return nil, fmt.Errorf("crdt '%s' is not an or set", name)
+}
+
+// PNCounter returns the increment/decrement counter with the given name, creating it if needed.
+func (s *CRDTStore) PNCounter(name string) (*PNCounter, error) {
+	c, err := s.getOrCreate(name, func() CRDT {
+		return &PNCounter{store: s, name: name, p: map[string]uint64{}, n: map[string]uint64{}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := c.(*PNCounter); ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("crdt '%s' is not a pn counter", name)
+}
+
+// getOrCreate returns the CRDT with the given name, a new one is merged with
+// the states received before it was created.
+func (s *CRDTStore) getOrCreate(name string, create func() CRDT) (CRDT, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c, ok := s.crdts[name]; ok {
+		return c, nil
+	}
+
+	c := create()
+	for _, state := range s.pending[name] {
+		if err := c.Merge(state); err != nil {
+			LogPrintf(LOG_WARN, "gossip", "merge pending crdt '%s' failed: %s", name, err.Error())
+		}
+	}
+	delete(s.pending, name)
+	s.crdts[name] = c
+	return c, nil
+}
+
+// publish broadcasts a full or partial state of a CRDT.
+func (s *CRDTStore) publish(name string, state interface{}) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		LogPrintf(LOG_WARN, "gossip", "encode crdt '%s' failed: %s", name, err.Error())
+		return
+	}
+	if err := s.gossip.PublishWith(crdtTopic, GossipCodecJSON, crdtMsg{Name: name, State: data}); err != nil {
+		LogPrintf(LOG_WARN, "gossip", "publish crdt '%s' failed: %s", name, err.Error())
+	}
+}
+
+// merge merges a remote state, it is kept until the CRDT is created locally.
+func (s *CRDTStore) merge(name string, state []byte) {
+	s.lock.Lock()
+	c, ok := s.crdts[name]
+	if !ok {
+		pending := append(s.pending[name], state)
+		if len(pending) > crdtMaxPending {
+			LogPrintf(LOG_WARN, "gossip", "drop pending state of crdt '%s'", name)
+			pending = pending[1:]
+		}
+		s.pending[name] = pending
+	}
+	s.lock.Unlock()
+
+	if ok {
+		if err := c.Merge(state); err != nil {
+			LogPrintf(LOG_WARN, "gossip", "merge crdt '%s' failed: %s", name, err.Error())
+		}
+	}
+}
+
+func (s *CRDTStore) localState() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	states := map[string]json.RawMessage{}
+	for name, c := range s.crdts {
+		state, err := c.State()
+		if err != nil {
+			LogPrintf(LOG_WARN, "gossip", "encode crdt '%s' failed: %s", name, err.Error())
+			continue
+		}
+		states[name] = state
+	}
+	data, _ := json.Marshal(states)
+	return data
+}
+
+func (s *CRDTStore) mergeRemoteState(buf []byte) {
+	states := map[string]json.RawMessage{}
+	if err := json.Unmarshal(buf, &states); err != nil {
+		LogPrintf(LOG_WARN, "gossip", "decode crdt state failed: %s", err.Error())
+		return
+	}
+	for name, state := range states {
+		s.merge(name, state)
+	}
+}
+
+// LWWMap is a map where the last write of a key wins, ties are broken by node name.
+type LWWMap struct {
+	store   *CRDTStore
+	name    string
+	lock    sync.Mutex
+	entries map[string]lwwEntry
+}
+
+type lwwEntry struct {
+	Value   []byte `json:"value,omitempty"`
+	Time    int64  `json:"time"`
+	Node    string `json:"node"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// newer checks whether e wins over other.
+func (e lwwEntry) newer(other lwwEntry) bool {
+	return e.Time > other.Time || (e.Time == other.Time && e.Node > other.Node)
+}
+
+// Set sets the value of the key and broadcasts it.
+func (m *LWWMap) Set(key string, value []byte) {
+	m.write(key, value, false)
+}
+
+// Delete deletes the key and broadcasts it.
+func (m *LWWMap) Delete(key string) {
+	m.write(key, nil, true)
+}
+
+// Get returns the value of the key.
+func (m *LWWMap) Get(key string) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.entries[key]
+	if !ok || e.Deleted {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Keys returns the keys of the map in ascending order.
+func (m *LWWMap) Keys() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keys := []string{}
+	for k, e := range m.entries {
+		if !e.Deleted {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *LWWMap) State() ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return json.Marshal(m.entries)
+}
+
+func (m *LWWMap) Merge(state []byte) error {
+	entries := map[string]lwwEntry{}
+	if err := json.Unmarshal(state, &entries); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for k, e := range entries {
+		if cur, ok := m.entries[k]; !ok || e.newer(cur) {
+			m.entries[k] = e
+		}
+	}
+	return nil
+}
+
+func (m *LWWMap) write(key string, value []byte, deleted bool) {
+	m.lock.Lock()
+	e := lwwEntry{Value: value, Time: time.Now().UnixNano(), Node: m.store.gossip.Name, Deleted: deleted}
+	// keep the clock moving forward when the local clock is behind the last write
+	if cur, ok := m.entries[key]; ok && !e.newer(cur) {
+		e.Time = cur.Time + 1
+	}
+	m.entries[key] = e
+	m.lock.Unlock()
+	m.store.publish(m.name, map[string]lwwEntry{key: e})
+}
+
+// ORSet is an observed-remove set, an add wins over a concurrent remove.
+type ORSet struct {
+	store   *CRDTStore
+	name    string
+	lock    sync.Mutex
+	adds    map[string]map[string]bool // element to the tags of its adds
+	removes map[string]bool            // tags of the removed adds
+}
+
+type orSetState struct {
+	Adds    map[string]map[string]bool `json:"adds,omitempty"`
+	Removes map[string]bool            `json:"removes,omitempty"`
+}
+
+// Add adds the element and broadcasts it.
+func (o *ORSet) Add(element string) {
+	tag := o.store.gossip.Name + "/" + uuid.New().String()
+	o.lock.Lock()
+	if o.adds[element] == nil {
+		o.adds[element] = map[string]bool{}
+	}
+	o.adds[element][tag] = true
+	o.lock.Unlock()
+	o.store.publish(o.name, orSetState{Adds: map[string]map[string]bool{element: {tag: true}}})
+}
+
+// Remove removes the adds of the element seen so far and broadcasts it.
+func (o *ORSet) Remove(element string) {
+	delta := orSetState{Removes: map[string]bool{}}
+	o.lock.Lock()
+	for tag := range o.adds[element] {
+		if !o.removes[tag] {
+			o.removes[tag] = true
+			delta.Removes[tag] = true
+		}
+	}
+	o.lock.Unlock()
+	if len(delta.Removes) > 0 {
+		o.store.publish(o.name, delta)
+	}
+}
+
+// Contains checks whether the element is in the set.
+func (o *ORSet) Contains(element string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.containsLocked(element)
+}
+
+// Elements returns the elements of the set in ascending order.
+func (o *ORSet) Elements() []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	elements := []string{}
+	for e := range o.adds {
+		if o.containsLocked(e) {
+			elements = append(elements, e)
+		}
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+func (o *ORSet) State() ([]byte, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return json.Marshal(orSetState{Adds: o.adds, Removes: o.removes})
+}
+
+func (o *ORSet) Merge(state []byte) error {
+	in := orSetState{}
+	if err := json.Unmarshal(state, &in); err != nil {
+		return err
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for e, tags := range in.Adds {
+		if o.adds[e] == nil {
+			o.adds[e] = map[string]bool{}
+		}
+		for tag := range tags {
+			o.adds[e][tag] = true
+		}
+	}
+	for tag := range in.Removes {
+		o.removes[tag] = true
+	}
+	return nil
+}
+
+func (o *ORSet) containsLocked(element string) bool {
+	for tag := range o.adds[element] {
+		if !o.removes[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// PNCounter is a counter which can be incremented and decremented on every node.
+// The counts are kept per process rather than per node name, so a node which
+// restarts under the same name starts a new entry instead of writing counts
+// lower than the ones the other nodes already merged.
+type PNCounter struct {
+	store *CRDTStore
+	name  string
+	lock  sync.Mutex
+	p     map[string]uint64 // increments per process
+	n     map[string]uint64 // decrements per process
+}
+
+type pnCounterState struct {
+	P map[string]uint64 `json:"p,omitempty"`
+	N map[string]uint64 `json:"n,omitempty"`
+}
+
+// Add adds delta to the counter and broadcasts it, delta may be negative.
+func (c *PNCounter) Add(delta int64) {
+	node := c.store.gossip.Name + "/" + c.store.process
+	c.lock.Lock()
+	if delta >= 0 {
+		c.p[node] += uint64(delta)
+	} else {
+		c.n[node] += uint64(-delta)
+	}
+	state := pnCounterState{
+		P: map[string]uint64{node: c.p[node]},
+		N: map[string]uint64{node: c.n[node]},
+	}
+	c.lock.Unlock()
+	c.store.publish(c.name, state)
+}
+
+// Value returns the value of the counter.
+func (c *PNCounter) Value() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var sum int64
+	for _, v := range c.p {
+		sum += int64(v)
+	}
+	for _, v := range c.n {
+		sum -= int64(v)
+	}
+	return sum
+}
+
+func (c *PNCounter) State() ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return json.Marshal(pnCounterState{P: c.p, N: c.n})
+}
+
+func (c *PNCounter) Merge(state []byte) error {
+	in := pnCounterState{}
+	if err := json.Unmarshal(state, &in); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for node, v := range in.P {
+		if v > c.p[node] {
+			c.p[node] = v
+		}
+	}
+	for node, v := range in.N {
+		if v > c.n[node] {
+			c.n[node] = v
+		}
+	}
+	return nil
+}
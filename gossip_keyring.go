@@ -0,0 +1,369 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// keyringTopic is the topic of the key rotation messages
+const keyringTopic = "utils.keyring"
+
+// defaultKeyRotationInterval is the time in seconds after which a key rotation step is sent again to the nodes which did not confirm it
+const defaultKeyRotationInterval = 5
+
+// keyFilePollInterval is the interval of checking a watched key file for changes
+const keyFilePollInterval = 5 * time.Second
+
+// keyringMsg is a step of a key rotation, or with Op "ack" the confirmation
+// of the step Step by a node
+type keyringMsg struct {
+	Op   string `json:"op"`
+	Step string `json:"step,omitempty"`
+	Key  []byte `json:"key"`
+}
+
+// keyRotation collects the nodes which confirmed the current step of a key rotation
+type keyRotation struct {
+	step  keyringMsg
+	acked map[string]bool
+	ack   chan struct{}
+}
+
+// InstallKey adds a key to the keyring, it decrypts messages but is not used
+// to encrypt them. A key is 16, 24 or 32 bytes to select AES-128, AES-192 or
+// AES-256. The first key installed before Start becomes the primary key.
+func (g *Gossip) InstallKey(key []byte) error {
+	if err := memberlist.ValidateKey(key); err != nil {
+		return err
+	}
+	kr, err := g.ring(true)
+	if err != nil {
+		return err
+	}
+	return kr.AddKey(key)
+}
+
+// UseKey makes an installed key the primary key, which encrypts messages.
+func (g *Gossip) UseKey(key []byte) error {
+	kr, err := g.ring(false)
+	if err != nil {
+		return err
+	}
+	return kr.UseKey(key)
+}
+
+// RemoveKey removes a key from the keyring, the primary key cannot be removed.
+func (g *Gossip) RemoveKey(key []byte) error {
+	kr, err := g.ring(false)
+	if err != nil {
+		return err
+	}
+	if primary := kr.GetPrimaryKey(); primary != nil && bytes.Equal(primary, key) {
+		return fmt.Errorf("removing the primary key is not allowed")
+	}
+	return kr.RemoveKey(key)
+}
+
+// ListKeys returns the keys of the keyring, the primary key first.
+func (g *Gossip) ListKeys() [][]byte {
+	kr, err := g.ring(false)
+	if err != nil {
+		return nil
+	}
+	return kr.GetKeys()
+}
+
+// RotateKey switches the whole cluster to a new primary key in three steps:
+// the key is installed on every node, then used, then the old primary key is
+// removed. Each step is sent to every alive member and the next step starts
+// only once all of them confirmed it, so no node encrypts with a key another
+// node does not have. The step is sent again every KeyRotationInterval seconds
+// to the members which did not confirm it. If ctx is done first the rotation
+// stops and the old key stays installed. The gossip has to be encrypted already.
+func (g *Gossip) RotateKey(ctx context.Context, key []byte) error {
+	if err := memberlist.ValidateKey(key); err != nil {
+		return err
+	}
+	if !g.IsReady() {
+		return fmt.Errorf("gossip is %s", g.State())
+	}
+	kr, err := g.ring(false)
+	if err != nil {
+		return err
+	}
+	old := kr.GetPrimaryKey()
+
+	g.lock.Lock()
+	if g.rotation != nil {
+		g.lock.Unlock()
+		return fmt.Errorf("key rotation in progress")
+	}
+	g.rotation = &keyRotation{ack: make(chan struct{}, 1)}
+	g.lock.Unlock()
+	defer func() {
+		g.lock.Lock()
+		g.rotation = nil
+		g.lock.Unlock()
+	}()
+
+	steps := []keyringMsg{{Op: "install", Key: key}, {Op: "use", Key: key}}
+	if !bytes.Equal(old, key) {
+		steps = append(steps, keyringMsg{Op: "remove", Key: old})
+	}
+	for _, step := range steps {
+		if err := g.rotateStep(ctx, step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateStep applies a step of a key rotation and sends it to the alive
+// members until every one of them confirmed it.
+func (g *Gossip) rotateStep(ctx context.Context, step keyringMsg) error {
+	frame, err := g.publishFrame(keyringTopic, GossipCodecJSON, step)
+	if err != nil {
+		return err
+	}
+	g.lock.Lock()
+	g.rotation.step = step
+	g.rotation.acked = map[string]bool{g.Name: true}
+	ack := g.rotation.ack
+	g.lock.Unlock()
+	if err := g.applyKeyOp(step); err != nil {
+		return err
+	}
+
+	interval := time.Duration(g.KeyRotationInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	resend := true
+	for {
+		missing := g.missingKeyAcks()
+		if len(missing) == 0 {
+			LogPrintf(LOG_INFO, "gossip", "key rotation step '%s' done", step.Op)
+			return nil
+		}
+		if resend {
+			LogPrintf(LOG_DEBUG, "gossip", "key rotation step '%s' waits for %s", step.Op, strings.Join(missing, ", "))
+			for _, node := range missing {
+				if err := g.SendTo(node, frame); err != nil {
+					LogPrintf(LOG_WARN, "gossip", "send key rotation step '%s' to '%s' failed: %s", step.Op, node, err.Error())
+				}
+			}
+		}
+
+		select {
+		case <-ack:
+			resend = false
+		case <-ticker.C:
+			resend = true
+		case <-ctx.Done():
+			return fmt.Errorf("key rotation step '%s' not confirmed by %s: %s", step.Op, strings.Join(missing, ", "), ctx.Err().Error())
+		}
+	}
+}
+
+// missingKeyAcks returns the alive members which did not confirm the current step.
+func (g *Gossip) missingKeyAcks() []string {
+	members, _ := g.Members("")
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	missing := []string{}
+	for _, m := range members {
+		if !g.rotation.acked[m.Name] {
+			missing = append(missing, m.Name)
+		}
+	}
+	return missing
+}
+
+// LoadKeyFile loads the keyring from a file of base64 keys, one per line and
+// the primary key first. Keys missing from the file are removed.
+func (g *Gossip) LoadKeyFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	keys := [][]byte{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return fmt.Errorf("bad key in '%s': %s", path, err.Error())
+		}
+		if err := memberlist.ValidateKey(key); err != nil {
+			return fmt.Errorf("bad key in '%s': %s", path, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys in '%s'", path)
+	}
+
+	for _, key := range keys {
+		if err := g.InstallKey(key); err != nil {
+			return err
+		}
+	}
+	if err := g.UseKey(keys[0]); err != nil {
+		return err
+	}
+	for _, installed := range g.ListKeys() {
+		found := false
+		for _, key := range keys {
+			found = found || bytes.Equal(installed, key)
+		}
+		if !found {
+			if err := g.RemoveKey(installed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WatchKeyFile loads the key file and reloads it whenever it changes until
+// ctx is done. It returns the error of the first load, later errors are logged.
+func (g *Gossip) WatchKeyFile(ctx context.Context, path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := g.LoadKeyFile(path); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(keyFilePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			s, err := os.Stat(path)
+			if err != nil {
+				LogPrintf(LOG_WARN, "gossip", "stat key file '%s' failed: %s", path, err.Error())
+				continue
+			}
+			if s.ModTime().Equal(stat.ModTime()) && s.Size() == stat.Size() {
+				continue
+			}
+			stat = s
+			if err := g.LoadKeyFile(path); err != nil {
+				LogPrintf(LOG_WARN, "gossip", "reload key file '%s' failed: %s", path, err.Error())
+				continue
+			}
+			LogPrintf(LOG_INFO, "gossip", "reloaded key file '%s'", path)
+		}
+	}()
+	return nil
+}
+
+// ring returns the keyring, which is created from SecretKey or on the first
+// InstallKey if create is set.
+func (g *Gossip) ring(create bool) (*memberlist.Keyring, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.keyring != nil {
+		return g.keyring, nil
+	}
+	if len(g.SecretKey) == 0 && !create {
+		return nil, fmt.Errorf("gossip has no keyring")
+	}
+	if g.state != GossipStateNew && g.state != GossipStateStopped {
+		return nil, fmt.Errorf("gossip is %s without encryption", g.state)
+	}
+
+	kr, err := memberlist.NewKeyring(nil, g.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	g.keyring = kr
+	return kr, nil
+}
+
+// applyKeyOp applies a step of a key rotation.
+func (g *Gossip) applyKeyOp(m keyringMsg) error {
+	switch m.Op {
+	case "install":
+		return g.InstallKey(m.Key)
+	case "use":
+		return g.UseKey(m.Key)
+	case "remove":
+		return g.RemoveKey(m.Key)
+	}
+	return fmt.Errorf("unknown key operation '%s'", m.Op)
+}
+
+// handleKeyringMsg applies a key rotation step received from another node,
+// it is ignored unless the gossip is encrypted.
+func (g *Gossip) handleKeyringMsg(msg *GossipMessage) {
+	g.lock.Lock()
+	encrypted := g.keyring != nil
+	g.lock.Unlock()
+	if !encrypted {
+		LogPrintf(LOG_WARN, "gossip", "ignore key rotation from '%s' on unencrypted gossip", msg.Sender)
+		return
+	}
+
+	m := keyringMsg{}
+	if err := msg.Decode(&m); err != nil {
+		LogPrintf(LOG_WARN, "gossip", "decode key rotation failed: %s", err.Error())
+		return
+	}
+	if m.Op == "ack" {
+		g.ackKeyStep(msg.Sender, m)
+		return
+	}
+	if err := g.applyKeyOp(m); err != nil {
+		LogPrintf(LOG_WARN, "gossip", "key rotation step '%s' from '%s' failed: %s", m.Op, msg.Sender, err.Error())
+		return
+	}
+	LogPrintf(LOG_INFO, "gossip", "key rotation step '%s' from '%s' applied", m.Op, msg.Sender)
+
+	// confirm the step to the rotating node, which waits for every node
+	// before the next step
+	frame, err := g.publishFrame(keyringTopic, GossipCodecJSON, keyringMsg{Op: "ack", Step: m.Op, Key: m.Key})
+	if err != nil {
+		LogPrintf(LOG_WARN, "gossip", "confirm key rotation failed: %s", err.Error())
+		return
+	}
+	go func() {
+		if err := g.SendTo(msg.Sender, frame); err != nil {
+			LogPrintf(LOG_WARN, "gossip", "confirm key rotation to '%s' failed: %s", msg.Sender, err.Error())
+		}
+	}()
+}
+
+// ackKeyStep records that the node applied the current step of the running rotation.
+func (g *Gossip) ackKeyStep(node string, m keyringMsg) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.rotation == nil || g.rotation.step.Op != m.Step || !bytes.Equal(g.rotation.step.Key, m.Key) {
+		return
+	}
+	g.rotation.acked[node] = true
+	select {
+	case g.rotation.ack <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// LeaderElector elects one leader among the gossip members with rendezvous
+// hashing: the member with the highest hash of the election name and its own
+// name leads, so every node agrees once membership has converged.
+//
+// The elector learns the members from the join and leave events, chained in
+// front of the NotifyJoinHandler and NotifyLeaveHandler already set on the
+// gossip: a handler assigned after NewLeaderElector cuts it off, and an
+// elector created on a running gossip misses the members which joined before.
+// The members of an earlier run are forgotten when the gossip starts again.
+type LeaderElector struct {
+	Name                string
+	LeaderChangeHandler func(leader string, isLeader bool)
+	gossip              *Gossip
+	lock                sync.Mutex
+	nodes               map[string]bool
+	leader              string
+	changed             chan struct{}
+}
+
+// leaderPollInterval is the interval of checking the gossip state while waiting for leadership
+const leaderPollInterval = time.Second
+
+func NewLeaderElector(g *Gossip, name string) *LeaderElector {
+	e := &LeaderElector{
+		Name:    name,
+		gossip:  g,
+		nodes:   map[string]bool{},
+		changed: make(chan struct{}),
+	}
+
+	join, leave := g.NotifyJoinHandler, g.NotifyLeaveHandler
+	g.NotifyJoinHandler = func(node *memberlist.Node) {
+		if join != nil {
+			join(node)
+		}
+		if node.Name == g.Name {
+			// the local node joins first on every start
+			e.reset()
+		}
+		e.update(node.Name, true)
+	}
+	g.NotifyLeaveHandler = func(node *memberlist.Node) {
+		if leave != nil {
+			leave(node)
+		}
+		e.update(node.Name, false)
+	}
+	return e
+}
+
+// Leader returns the name of the leader, empty if there are no members.
+func (e *LeaderElector) Leader() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.leader
+}
+
+// IsLeader checks whether the local node leads and the gossip is ready.
+func (e *LeaderElector) IsLeader() bool {
+	return e.Leader() == e.gossip.Name && e.gossip.IsReady()
+}
+
+// RunSingleton runs fn while the local node leads, its context is cancelled
+// when the leadership is lost and fn runs again once it is regained. It
+// returns the result of fn if fn returns while still leading, or the error
+// of ctx when it is done.
+func (e *LeaderElector) RunSingleton(ctx context.Context, fn func(ctx context.Context) error) error {
+	for {
+		if err := e.waitLeader(ctx); err != nil {
+			return err
+		}
+
+		runCtx, cancel := context.WithCancel(ctx)
+		go e.watch(runCtx, cancel)
+		err := fn(runCtx)
+		lost := runCtx.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !lost {
+			return err
+		}
+	}
+}
+
+// waitLeader waits until the local node leads, the state of the gossip is
+// polled as it does not raise events.
+func (e *LeaderElector) waitLeader(ctx context.Context) error {
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+	for {
+		changed := e.changes()
+		if e.IsLeader() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// watch cancels ctx when the local node stops leading.
+func (e *LeaderElector) watch(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+	for {
+		changed := e.changes()
+		if !e.IsLeader() {
+			cancel()
+			return
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-e.gossip.Done():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// changes returns a channel which is closed when the leader changes.
+func (e *LeaderElector) changes() <-chan struct{} {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.changed
+}
+
+// reset forgets the nodes of an earlier run of the gossip.
+func (e *LeaderElector) reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.nodes = map[string]bool{}
+}
+
+// update adds or removes a node and elects the leader again.
+func (e *LeaderElector) update(node string, alive bool) {
+	e.lock.Lock()
+	if alive {
+		e.nodes[node] = true
+	} else {
+		delete(e.nodes, node)
+	}
+
+	var leader string
+	var best uint64
+	for n := range e.nodes {
+		if h := rendezvousHash(e.Name, n); leader == "" || h > best || (h == best && n > leader) {
+			leader, best = n, h
+		}
+	}
+	if leader == e.leader {
+		e.lock.Unlock()
+		return
+	}
+	e.leader = leader
+	close(e.changed)
+	e.changed = make(chan struct{})
+	e.lock.Unlock()
+
+	LogPrintf(LOG_INFO, "gossip", "leader of '%s' is '%s'", e.Name, leader)
+	if e.LeaderChangeHandler != nil {
+		e.LeaderChangeHandler(leader, leader == e.gossip.Name)
+	}
+}
+
+// rendezvousHash returns the weight of node for key, the FNV-1a hash is
+// mixed so similar names spread over the whole range.
+func rendezvousHash(key string, node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(node))
+	return mix64(h.Sum64())
+}
+
+// mix64 spreads the bits of a hash with the MurmurHash3 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
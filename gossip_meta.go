@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// gossipUpdateMetaTimeout is the time to wait for a metadata update to be broadcast
+const gossipUpdateMetaTimeout = 10 * time.Second
+
+// gossipDeadRetention is the time dead and left members are kept in MembersWithDead
+const gossipDeadRetention = time.Minute
+
+// NodeMeta is the metadata of a node, it is encoded as JSON within
+// memberlist.MetaMaxSize bytes. Weight is read by HashRing.
+type NodeMeta struct {
+	Labels   map[string]string `json:"labels,omitempty"`
+	Services map[string]int    `json:"services,omitempty"`
+	Version  string            `json:"version,omitempty"`
+	Role     string            `json:"role,omitempty"`
+	Weight   int               `json:"weight,omitempty"`
+}
+
+// GossipMember is a member of the gossip
+type GossipMember struct {
+	Name  string
+	Addr  string
+	Port  uint16
+	Meta  NodeMeta
+	State GossipMemberState
+}
+
+// GossipMemberState is the state of a member as seen by the local node, it is
+// either alive or dead. Members which left count as dead, and a member the
+// others merely suspect is still alive until it is declared dead.
+type GossipMemberState string
+
+const (
+	GossipMemberAlive GossipMemberState = "alive"
+	GossipMemberDead  GossipMemberState = "dead"
+)
+
+// gossipNode is a copy of a memberlist node taken in a membership event
+type gossipNode struct {
+	memberlist.Node
+	since time.Time
+}
+
+func (n *gossipNode) dead() bool {
+	return n.State == memberlist.StateDead
+}
+
+// UpdateMeta sets the metadata of the local node, it replaces NodeMetaHandler.
+// If the gossip is running the update is broadcast to the other nodes.
+func (g *Gossip) UpdateMeta(meta NodeMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if len(data) > memberlist.MetaMaxSize {
+		return fmt.Errorf("node meta is %d bytes, limit is %d", len(data), memberlist.MetaMaxSize)
+	}
+
+	g.lock.Lock()
+	g.meta = data
+	ml, ready := g.members, g.state == GossipStateReady
+	g.lock.Unlock()
+
+	if !ready {
+		return nil
+	}
+	return ml.UpdateNode(gossipUpdateMetaTimeout)
+}
+
+// Members returns the alive members with labels matching the selector in
+// name order, an empty selector matches every member. See ParseLabelSelector.
+func (g *Gossip) Members(selector string) ([]GossipMember, error) {
+	return g.listMembers(selector, false)
+}
+
+// MembersWithDead returns the members like Members, including the members
+// which died or left in the last minute with State GossipMemberDead.
+func (g *Gossip) MembersWithDead(selector string) ([]GossipMember, error) {
+	return g.listMembers(selector, true)
+}
+
+func (g *Gossip) listMembers(selector string, withDead bool) ([]GossipMember, error) {
+	sel, err := ParseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	// memberlist updates the nodes it returns in place, so the members come
+	// from the copies taken in the membership events. Dead members expire
+	// here as well, trackNode only drops them on the next event.
+	now := time.Now()
+	g.lock.Lock()
+	nodes := make([]gossipNode, 0, len(g.nodes))
+	for _, n := range g.nodes {
+		if n.dead() && (!withDead || now.Sub(n.since) > gossipDeadRetention) {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	g.lock.Unlock()
+
+	members := []GossipMember{}
+	for i := range nodes {
+		n := &nodes[i].Node
+		m := GossipMember{Name: n.Name, Addr: n.Addr.String(), Port: n.Port, Meta: decodeNodeMeta(n)}
+		m.State = GossipMemberAlive
+		if nodes[i].dead() {
+			m.State = GossipMemberDead
+		}
+		if sel.Matches(m.Meta.Labels) {
+			members = append(members, m)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members, nil
+}
+
+// trackNode keeps a copy of the node for Members, and calls NotifyMetaHandler
+// if the metadata of a live node changed.
+func (g *Gossip) trackNode(node *memberlist.Node, left bool) {
+	now := time.Now()
+	n := gossipNode{Node: *node, since: now}
+	n.Addr = append(n.Addr[:0:0], node.Addr...)
+	n.Meta = append([]byte{}, node.Meta...)
+	// the state of the node is not kept up to date by memberlist
+	n.State = memberlist.StateAlive
+	if left {
+		n.State = memberlist.StateDead
+	}
+
+	g.lock.Lock()
+	if g.nodes == nil {
+		g.nodes = map[string]gossipNode{}
+	}
+	old, known := g.nodes[node.Name]
+	g.nodes[node.Name] = n
+	for name, x := range g.nodes {
+		if x.dead() && now.Sub(x.since) > gossipDeadRetention {
+			delete(g.nodes, name)
+		}
+	}
+	g.lock.Unlock()
+
+	if left || !known || old.dead() || string(old.Meta) == string(node.Meta) || g.NotifyMetaHandler == nil {
+		return
+	}
+	g.NotifyMetaHandler(node.Name, decodeNodeMeta(node))
+}
+
+// decodeNodeMeta decodes the metadata of a node, metadata which is not a
+// NodeMeta decodes as empty.
+func decodeNodeMeta(node *memberlist.Node) NodeMeta {
+	meta := NodeMeta{}
+	if len(node.Meta) > 0 {
+		if err := json.Unmarshal(node.Meta, &meta); err != nil {
+			return NodeMeta{}
+		}
+	}
+	return meta
+}
+
+// LabelSelector filters labels with a list of requirements which all have to match
+type LabelSelector []labelRequirement
+
+type labelRequirement struct {
+	key    string
+	op     string
+	values []string
+}
+
+// ParseLabelSelector parses a comma separated list of requirements:
+//
+//	key=value, key==value  the label equals value
+//	key!=value             the label is missing or does not equal value
+//	key                    the label exists
+//	!key                   the label does not exist
+//	key in (v1,v2)         the label equals one of the values
+//	key notin (v1,v2)      the label is missing or equals none of the values
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	sel := LabelSelector{}
+	for _, part := range splitSelector(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		r := labelRequirement{}
+		switch {
+		case strings.HasPrefix(part, "!"):
+			r.key, r.op = strings.TrimSpace(part[1:]), "!"
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r.key, r.op, r.values = strings.TrimSpace(kv[0]), "!=", []string{strings.TrimSpace(kv[1])}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(strings.Replace(part, "==", "=", 1), "=", 2)
+			r.key, r.op, r.values = strings.TrimSpace(kv[0]), "=", []string{strings.TrimSpace(kv[1])}
+		case strings.HasSuffix(part, ")"):
+			open := strings.Index(part, "(")
+			fields := strings.Fields(part[:maxint(open, 0)])
+			if open < 0 || len(fields) != 2 || (fields[1] != "in" && fields[1] != "notin") {
+				return nil, fmt.Errorf("bad label requirement '%s'", part)
+			}
+			r.key, r.op = fields[0], fields[1]
+			for _, v := range strings.Split(part[open+1:len(part)-1], ",") {
+				r.values = append(r.values, strings.TrimSpace(v))
+			}
+		default:
+			r.key, r.op = part, "exists"
+		}
+		if r.key == "" || strings.ContainsAny(r.key, " ()!=") {
+			return nil, fmt.Errorf("bad label requirement '%s'", part)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// Matches checks whether the labels match every requirement of the selector.
+func (sel LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		v, ok := labels[r.key]
+		switch r.op {
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		case "=", "in":
+			if !ok || !containsString(r.values, v) {
+				return false
+			}
+		case "!=", "notin":
+			if ok && containsString(r.values, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// splitSelector splits the selector at the commas outside of parentheses.
+func splitSelector(s string) []string {
+	parts := []string{}
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func containsString(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMetricsInterval is the interval in seconds of reporting the gauges to the metrics sink
+const defaultMetricsInterval = 10
+
+// MetricsSink receives the metrics of a gossip
+type MetricsSink interface {
+	IncrCounter(name string, labels map[string]string, delta float64)
+	SetGauge(name string, labels map[string]string, value float64)
+}
+
+// GossipStats is a snapshot of the counters and health of a gossip
+type GossipStats struct {
+	State       GossipState
+	HealthScore int
+	Queued      int
+	Sent        uint64
+	Received    uint64
+	Merges      uint64
+}
+
+// HealthScore returns the awareness of the local node, 0 is healthy and a
+// higher score means the node has trouble reaching the others in time.
+func (g *Gossip) HealthScore() int {
+	if ml := g.list(); ml != nil {
+		return ml.GetHealthScore()
+	}
+	return 0
+}
+
+// QueueLength returns the number of broadcasts waiting to be sent.
+func (g *Gossip) QueueLength() int {
+	g.lock.Lock()
+	queue := g.queue
+	g.lock.Unlock()
+	if queue == nil {
+		return 0
+	}
+	return queue.NumQueued()
+}
+
+// Stats returns the counters and health of the gossip.
+func (g *Gossip) Stats() GossipStats {
+	stats := GossipStats{HealthScore: g.HealthScore(), Queued: g.QueueLength()}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	stats.State = g.state
+	stats.Sent, stats.Received, stats.Merges = g.sent, g.received, g.merges
+	return stats
+}
+
+// ReportMetrics sets the gauges of the metrics sink, it is called every
+// MetricsInterval seconds while the gossip runs. gossip_members has a state
+// label of alive or dead, dead members are counted until they expire.
+func (g *Gossip) ReportMetrics() {
+	if g.Metrics == nil {
+		return
+	}
+	g.Metrics.SetGauge("gossip_health_score", nil, float64(g.HealthScore()))
+	g.Metrics.SetGauge("gossip_queue_length", nil, float64(g.QueueLength()))
+
+	counts := map[GossipMemberState]int{GossipMemberAlive: 0, GossipMemberDead: 0}
+	if members, err := g.MembersWithDead(""); err == nil {
+		for _, m := range members {
+			counts[m.State]++
+		}
+	}
+	for state, n := range counts {
+		g.Metrics.SetGauge("gossip_members", map[string]string{"state": string(state)}, float64(n))
+	}
+}
+
+// reportMetrics calls ReportMetrics until the gossip stops.
+func (g *Gossip) reportMetrics() {
+	if g.Metrics == nil || g.MetricsInterval <= 0 {
+		return
+	}
+	done := g.Done()
+	go func() {
+		ticker := time.NewTicker(time.Duration(g.MetricsInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			g.ReportMetrics()
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// countSent counts a message sent as a broadcast or directly to a node.
+func (g *Gossip) countSent(kind string) {
+	g.lock.Lock()
+	g.sent++
+	g.lock.Unlock()
+	if g.Metrics != nil {
+		g.Metrics.IncrCounter("gossip_messages_sent_total", map[string]string{"kind": kind}, 1)
+	}
+}
+
+func (g *Gossip) countReceived() {
+	g.lock.Lock()
+	g.received++
+	g.lock.Unlock()
+	if g.Metrics != nil {
+		g.Metrics.IncrCounter("gossip_messages_received_total", nil, 1)
+	}
+}
+
+func (g *Gossip) countMerge() {
+	g.lock.Lock()
+	g.merges++
+	g.lock.Unlock()
+	if g.Metrics != nil {
+		g.Metrics.IncrCounter("gossip_merges_total", nil, 1)
+	}
+}
+
+// PrometheusSink keeps the metrics and serves them in the Prometheus text
+// exposition format.
+type PrometheusSink struct {
+	lock   sync.Mutex
+	types  map[string]string
+	series map[string]map[string]float64 // metric name to labels to value
+}
+
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		types:  map[string]string{},
+		series: map[string]map[string]float64{},
+	}
+}
+
+func (s *PrometheusSink) IncrCounter(name string, labels map[string]string, delta float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values(name, "counter")[prometheusLabels(labels)] += delta
+}
+
+func (s *PrometheusSink) SetGauge(name string, labels map[string]string, value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values(name, "gauge")[prometheusLabels(labels)] = value
+}
+
+// WriteTo writes the metrics in name and label order.
+func (s *PrometheusSink) WriteTo(w io.Writer) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := make([]string, 0, len(s.series))
+	for name := range s.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, s.types[name])
+		labels := make([]string, 0, len(s.series[name]))
+		for l := range s.series[name] {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(&sb, "%s%s %s\n", name, l, strconv.FormatFloat(s.series[name][l], 'g', -1, 64))
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics, so the sink can be registered as /metrics.
+func (s *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := s.WriteTo(w); err != nil {
+		LogPrintf(LOG_WARN, "gossip", "write metrics failed: %s", err.Error())
+	}
+}
+
+func (s *PrometheusSink) values(name string, kind string) map[string]float64 {
+	if s.series[name] == nil {
+		s.series[name] = map[string]float64{}
+		s.types[name] = kind
+	}
+	return s.series[name]
+}
+
+// prometheusLabels formats labels as {k1="v1",k2="v2"} in key order.
+func prometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		parts = append(parts, k+`="`+v+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// defaultRequestTimeout is the timeout of a request in seconds, if the context has no deadline
+const defaultRequestTimeout = 10
+
+type gossipResponse struct {
+	data []byte
+	err  error
+}
+
+// gossipRequest is a pending request, only a response naming the node it was
+// sent to is accepted
+type gossipRequest struct {
+	node string
+	ch   chan gossipResponse
+}
+
+// SendTo sends msg to the node reliably over TCP, it arrives in the
+// NotifyMsgHandler of the node. The receiver is not told the sender, a sender
+// named in msg is only what the sender claims.
+func (g *Gossip) SendTo(node string, msg []byte) error {
+	ml, n, err := g.node(node)
+	if err != nil {
+		return err
+	}
+	g.countSent("direct")
+	return ml.SendReliable(n, msg)
+}
+
+// SendBestEffortTo sends msg to the node over UDP, it may be lost.
+func (g *Gossip) SendBestEffortTo(node string, msg []byte) error {
+	ml, n, err := g.node(node)
+	if err != nil {
+		return err
+	}
+	g.countSent("direct")
+	return ml.SendBestEffort(n, msg)
+}
+
+// Request sends req to the RequestHandler of the node and waits for its
+// response. It fails when ctx is done, or after RequestTimeout seconds if ctx
+// has no deadline.
+//
+// The node names in the request and the response are declared by the sending
+// nodes and are not authenticated: any node which can join the cluster may
+// pass the from of a RequestHandler or answer a request in the name of another
+// node. Only the SecretKey keeps other nodes out, do not rely on the names for
+// access control.
+func (g *Gossip) Request(ctx context.Context, node string, req []byte) ([]byte, error) {
+	ml, n, err := g.node(node)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok && g.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(g.RequestTimeout)*time.Second)
+		defer cancel()
+	}
+
+	ch := make(chan gossipResponse, 1)
+	g.lock.Lock()
+	if g.requests == nil {
+		g.requests = map[uint64]gossipRequest{}
+	}
+	g.requestID++
+	id := g.requestID
+	g.requests[id] = gossipRequest{node: node, ch: ch}
+	g.lock.Unlock()
+	defer func() {
+		g.lock.Lock()
+		delete(g.requests, id)
+		g.lock.Unlock()
+	}()
+
+	frame := append(append([]byte{}, gossipFrameMagic...), gossipFrameRequest)
+	frame = appendUvarint(frame, id)
+	frame = appendUvarint(frame, uint64(len(g.Name)))
+	frame = append(frame, g.Name...)
+	frame = append(frame, req...)
+	g.countSent("direct")
+	if err := ml.SendReliable(n, frame); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp.data, resp.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("request to node '%s' failed: %s", node, ctx.Err().Error())
+	}
+}
+
+// node returns the memberlist and the member with the given name.
+func (g *Gossip) node(name string) (*memberlist.Memberlist, *memberlist.Node, error) {
+	ml := g.list()
+	if ml == nil {
+		return nil, nil, fmt.Errorf("gossip not started")
+	}
+	for _, n := range ml.Members() {
+		if n.Name == name {
+			return ml, n, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("node '%s' not found", name)
+}
+
+// handleRequest runs the RequestHandler and sends its response back to the
+// sender, it does not block the delivery of other messages.
+func (g *Gossip) handleRequest(body []byte) {
+	id, body, err := frameUvarint(body)
+	if err != nil {
+		LogPrintf(LOG_WARN, "gossip", "decode request failed: %s", err.Error())
+		return
+	}
+	sender, req, err := frameBytes(body)
+	if err != nil {
+		LogPrintf(LOG_WARN, "gossip", "decode request failed: %s", err.Error())
+		return
+	}
+	req = append([]byte{}, req...)
+
+	go func() {
+		var data []byte
+		var err error
+		if g.RequestHandler == nil {
+			err = fmt.Errorf("node '%s' has no request handler", g.Name)
+		} else {
+			data, err = g.RequestHandler(string(sender), req)
+		}
+
+		frame := append(append([]byte{}, gossipFrameMagic...), gossipFrameResponse)
+		frame = appendUvarint(frame, id)
+		frame = appendUvarint(frame, uint64(len(g.Name)))
+		frame = append(frame, g.Name...)
+		if err != nil {
+			frame = append(append(frame, 1), err.Error()...)
+		} else {
+			frame = append(append(frame, 0), data...)
+		}
+		if err := g.SendTo(string(sender), frame); err != nil {
+			LogPrintf(LOG_WARN, "gossip", "send response to node '%s' failed: %s", sender, err.Error())
+		}
+	}()
+}
+
+// handleResponse hands a response to its pending request, late responses and
+// responses naming another node than the one the request was sent to are
+// dropped. memberlist does not pass the source address of a message, so the
+// check guards against misrouted responses, not forged ones.
+func (g *Gossip) handleResponse(body []byte) {
+	id, body, err := frameUvarint(body)
+	var sender []byte
+	if err == nil {
+		sender, body, err = frameBytes(body)
+	}
+	if err != nil || len(body) < 1 {
+		LogPrintf(LOG_WARN, "gossip", "decode response failed: frame is truncated")
+		return
+	}
+
+	g.lock.Lock()
+	req, ok := g.requests[id]
+	g.lock.Unlock()
+	if !ok {
+		LogPrintf(LOG_DEBUG, "gossip", "drop response of finished request %d", id)
+		return
+	}
+	if req.node != string(sender) {
+		LogPrintf(LOG_WARN, "gossip", "drop response of request %d to node '%s' from node '%s'", id, req.node, sender)
+		return
+	}
+
+	resp := gossipResponse{data: append([]byte{}, body[1:]...)}
+	if body[0] != 0 {
+		resp = gossipResponse{err: fmt.Errorf("%s", body[1:])}
+	}
+	select {
+	case req.ch <- resp:
+	default:
+	}
+}
@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// defaultRingVirtualNodes is the number of points of a node per unit of weight
+const defaultRingVirtualNodes = 64
+
+// RingMaxWeight is the largest weight of a node, higher weights are lowered
+// to it so a node cannot make the ring allocate without bound
+const RingMaxWeight = 100
+
+// HashRing partitions keys over the gossip members with consistent hashing.
+// Every member gets VirtualNodes points on the ring per unit of weight, and
+// a key is owned by the member of the first point at or after its hash.
+//
+// The weights are read from the membership events, so NewHashRing must see
+// the join of every member: call it before Start, and after the gossip's own
+// NotifyJoinHandler, NotifyLeaveHandler and NotifyUpdateHandler are assigned,
+// which the ring calls before updating itself. The nodes of an earlier run are
+// dropped when the gossip starts again.
+type HashRing struct {
+	VirtualNodes int
+	// WeightHandler returns the weight of a node, a node of weight 0 or less
+	// owns no keys and weights above RingMaxWeight count as RingMaxWeight. By
+	// default it is the "weight" field of the node meta as a JSON object, or 1.
+	WeightHandler func(*memberlist.Node) int
+	// RebalanceHandler is called with the tracked keys which changed owner
+	// after the ring was rebuilt. It runs in the memberlist event loop and
+	// must not block.
+	RebalanceHandler func(moved []RingMove)
+	lock             sync.RWMutex
+	weights          map[string]int
+	points           []ringPoint
+	keys             map[string]bool
+}
+
+// RingMove is a key which changed owner, From is empty if there was no owner.
+type RingMove struct {
+	Key  string
+	From string
+	To   string
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func NewHashRing(g *Gossip) *HashRing {
+	r := &HashRing{
+		VirtualNodes:  defaultRingVirtualNodes,
+		WeightHandler: defaultWeightHandler,
+		weights:       map[string]int{},
+		keys:          map[string]bool{},
+	}
+
+	join, leave, update := g.NotifyJoinHandler, g.NotifyLeaveHandler, g.NotifyUpdateHandler
+	g.NotifyJoinHandler = func(node *memberlist.Node) {
+		if join != nil {
+			join(node)
+		}
+		// the local node joins first on every start, the nodes of an
+		// earlier run are dropped
+		r.update(node.Name, r.WeightHandler(node), node.Name == g.Name)
+	}
+	g.NotifyLeaveHandler = func(node *memberlist.Node) {
+		if leave != nil {
+			leave(node)
+		}
+		r.update(node.Name, 0, false)
+	}
+	g.NotifyUpdateHandler = func(node *memberlist.Node) {
+		if update != nil {
+			update(node)
+		}
+		r.update(node.Name, r.WeightHandler(node), false)
+	}
+	return r
+}
+
+// Owner returns the node owning the key, empty if the ring is empty.
+func (r *HashRing) Owner(key string) string {
+	owners := r.Owners(key, 1)
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+// Owners returns up to n distinct nodes for the key, the owner first and then
+// the replicas in ring order.
+func (r *HashRing) Owners(key string, n int) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.ownersLocked(key, n)
+}
+
+// Nodes returns the nodes on the ring and their weights.
+func (r *HashRing) Nodes() map[string]int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	nodes := make(map[string]int, len(r.weights))
+	for n, w := range r.weights {
+		nodes[n] = w
+	}
+	return nodes
+}
+
+// Track adds keys reported to RebalanceHandler when their owner changes.
+func (r *HashRing) Track(keys ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, k := range keys {
+		r.keys[k] = true
+	}
+}
+
+// Untrack removes tracked keys.
+func (r *HashRing) Untrack(keys ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, k := range keys {
+		delete(r.keys, k)
+	}
+}
+
+func (r *HashRing) ownersLocked(key string, n int) []string {
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.weights) {
+		n = len(r.weights)
+	}
+
+	h := ringHash(key)
+	at := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	owners := make([]string, 0, n)
+	seen := map[string]bool{}
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		p := r.points[(at+i)%len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			owners = append(owners, p.node)
+		}
+	}
+	return owners
+}
+
+// update sets the weight of a node and rebuilds the ring if it changed, with
+// reset the other nodes are removed.
+func (r *HashRing) update(node string, weight int, reset bool) {
+	if weight > RingMaxWeight {
+		LogPrintf(LOG_WARN, "gossip", "lower weight %d of node '%s' to %d", weight, node, RingMaxWeight)
+		weight = RingMaxWeight
+	}
+	r.lock.Lock()
+	w, ok := r.weights[node]
+	stale := 0
+	if reset {
+		if stale = len(r.weights); ok {
+			stale--
+		}
+	}
+	if stale == 0 && ((ok && w == weight) || (!ok && weight <= 0)) {
+		r.lock.Unlock()
+		return
+	}
+
+	before := make(map[string]string, len(r.keys))
+	for k := range r.keys {
+		before[k] = r.ownerLocked(k)
+	}
+
+	if reset {
+		r.weights = map[string]int{}
+	}
+	if weight <= 0 {
+		delete(r.weights, node)
+	} else {
+		r.weights[node] = weight
+	}
+	r.rebuildLocked()
+
+	moved := []RingMove{}
+	for k, from := range before {
+		if to := r.ownerLocked(k); to != from {
+			moved = append(moved, RingMove{Key: k, From: from, To: to})
+		}
+	}
+	r.lock.Unlock()
+
+	LogPrintf(LOG_DEBUG, "gossip", "ring rebuilt with %d nodes, %d keys moved", len(r.weights), len(moved))
+	if len(moved) > 0 && r.RebalanceHandler != nil {
+		sort.Slice(moved, func(i, j int) bool { return moved[i].Key < moved[j].Key })
+		r.RebalanceHandler(moved)
+	}
+}
+
+// ownerLocked returns the owner of the key with the lock held.
+func (r *HashRing) ownerLocked(key string) string {
+	if owners := r.ownersLocked(key, 1); len(owners) > 0 {
+		return owners[0]
+	}
+	return ""
+}
+
+func (r *HashRing) rebuildLocked() {
+	vnodes := r.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+	r.points = r.points[:0]
+	for node, weight := range r.weights {
+		for i := 0; i < vnodes*weight; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+}
+
+// defaultWeightHandler reads the "weight" field of the node meta, or returns 1.
+func defaultWeightHandler(node *memberlist.Node) int {
+	meta := struct {
+		Weight *int `json:"weight"`
+	}{}
+	if len(node.Meta) == 0 || json.Unmarshal(node.Meta, &meta) != nil || meta.Weight == nil {
+		return 1
+	}
+	return *meta.Weight
+}
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
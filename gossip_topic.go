@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// GossipCodec is the encoding of a published payload
+type GossipCodec uint8
+
+const (
+	GossipCodecJSON GossipCodec = iota
+	GossipCodecMsgpack
+	GossipCodecRaw
+)
+
+// GossipMessage is a message published on a topic
+type GossipMessage struct {
+	Topic   string
+	Sender  string
+	Seq     uint64
+	Codec   GossipCodec
+	Payload []byte
+}
+
+// Decode decodes the payload into v with the codec of the message, raw
+// payloads decode into a *[]byte.
+func (m *GossipMessage) Decode(v interface{}) error {
+	switch m.Codec {
+	case GossipCodecJSON:
+		return json.Unmarshal(m.Payload, v)
+	case GossipCodecMsgpack:
+		return codec.NewDecoderBytes(m.Payload, &codec.MsgpackHandle{}).Decode(v)
+	case GossipCodecRaw:
+		if p, ok := v.(*[]byte); ok {
+			*p = m.Payload
+			return nil
+		}
+		return fmt.Errorf("raw payload of topic '%s' needs *[]byte, got %T", m.Topic, v)
+	}
+	return fmt.Errorf("unknown codec %d of topic '%s'", m.Codec, m.Topic)
+}
+
+// Frames sent by the gossip are prefixed with gossipFrameMagic and a kind, the
+// messages without the prefix go to NotifyMsgHandler.
+//
+// A publish frame is followed by:
+//
+//	codec  uint8
+//	seq    uvarint
+//	sender uvarint length, bytes
+//	topic  uvarint length, bytes
+//	payload, the rest of the frame
+//
+// A request frame is followed by:
+//
+//	id     uvarint
+//	sender uvarint length, bytes
+//	payload, the rest of the frame
+//
+// A response frame is followed by:
+//
+//	id     uvarint
+//	sender uvarint length, bytes
+//	status uint8, 0 for success or 1 for an error message in the payload
+//	payload, the rest of the frame
+var gossipFrameMagic = []byte{0xc7, 0xe7}
+
+const (
+	gossipFramePublish uint8 = iota + 1
+	gossipFrameRequest
+	gossipFrameResponse
+)
+
+// Subscribe sets the handler of the messages published on topic, replacing
+// the previous one.
+func (g *Gossip) Subscribe(topic string, handler func(*GossipMessage)) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.topics == nil {
+		g.topics = map[string]func(*GossipMessage){}
+	}
+	g.topics[topic] = handler
+}
+
+// Unsubscribe removes the handler of topic.
+func (g *Gossip) Unsubscribe(topic string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.topics, topic)
+}
+
+// Publish broadcasts v on topic, a []byte is sent raw and anything else is
+// encoded with the Codec of the gossip.
+func (g *Gossip) Publish(topic string, v interface{}) error {
+	if raw, ok := v.([]byte); ok {
+		return g.PublishWith(topic, GossipCodecRaw, raw)
+	}
+	return g.PublishWith(topic, g.Codec, v)
+}
+
+// PublishWith broadcasts v on topic encoded with codec.
+func (g *Gossip) PublishWith(topic string, c GossipCodec, v interface{}) error {
+	frame, err := g.publishFrame(topic, c, v)
+	if err != nil {
+		return err
+	}
+	g.Broadcast(frame)
+	return nil
+}
+
+// publishFrame encodes v and wraps it in a publish frame.
+func (g *Gossip) publishFrame(topic string, c GossipCodec, v interface{}) ([]byte, error) {
+	var payload []byte
+	switch c {
+	case GossipCodecJSON:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		payload = data
+	case GossipCodecMsgpack:
+		if err := codec.NewEncoderBytes(&payload, &codec.MsgpackHandle{}).Encode(v); err != nil {
+			return nil, err
+		}
+	case GossipCodecRaw:
+		raw, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("raw payload of topic '%s' needs []byte, got %T", topic, v)
+		}
+		payload = raw
+	default:
+		return nil, fmt.Errorf("unknown codec %d of topic '%s'", c, topic)
+	}
+
+	g.lock.Lock()
+	g.seq++
+	seq := g.seq
+	g.lock.Unlock()
+
+	buf := make([]byte, 0, len(gossipFrameMagic)+2+3*binary.MaxVarintLen64+len(g.Name)+len(topic)+len(payload))
+	buf = append(buf, gossipFrameMagic...)
+	buf = append(buf, gossipFramePublish, uint8(c))
+	buf = appendUvarint(buf, seq)
+	buf = appendUvarint(buf, uint64(len(g.Name)))
+	buf = append(buf, g.Name...)
+	buf = appendUvarint(buf, uint64(len(topic)))
+	buf = append(buf, topic...)
+	return append(buf, payload...), nil
+}
+
+// dispatch hands a frame to its handler, it returns false if msg is not a frame.
+func (g *Gossip) dispatch(msg []byte) bool {
+	if len(msg) <= len(gossipFrameMagic) || !bytes.HasPrefix(msg, gossipFrameMagic) {
+		return false
+	}
+
+	kind, body := msg[len(gossipFrameMagic)], msg[len(gossipFrameMagic)+1:]
+	switch kind {
+	case gossipFramePublish:
+		m, err := decodePublishFrame(body)
+		if err != nil {
+			LogPrintf(LOG_WARN, "gossip", "decode message failed: %s", err.Error())
+			return true
+		}
+		g.lock.Lock()
+		handler := g.topics[m.Topic]
+		g.lock.Unlock()
+		if handler == nil {
+			LogPrintf(LOG_DEBUG, "gossip", "no subscriber of topic '%s'", m.Topic)
+			return true
+		}
+		handler(m)
+	case gossipFrameRequest:
+		g.handleRequest(body)
+	case gossipFrameResponse:
+		g.handleResponse(body)
+	default:
+		LogPrintf(LOG_WARN, "gossip", "unknown frame kind %d", kind)
+	}
+	return true
+}
+
+func decodePublishFrame(body []byte) (*GossipMessage, error) {
+	if len(body) < 1 {
+		return nil, fmt.Errorf("publish frame is truncated")
+	}
+	m := &GossipMessage{Codec: GossipCodec(body[0])}
+	var sender, topic []byte
+	var err error
+	if m.Seq, body, err = frameUvarint(body[1:]); err != nil {
+		return nil, err
+	}
+	if sender, body, err = frameBytes(body); err != nil {
+		return nil, err
+	}
+	if topic, body, err = frameBytes(body); err != nil {
+		return nil, err
+	}
+	m.Sender, m.Topic, m.Payload = string(sender), string(topic), body
+	return m, nil
+}
+
+// frameUvarint reads a uvarint from the frame body and returns the rest.
+func frameUvarint(body []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(body)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("frame is truncated")
+	}
+	return v, body[n:], nil
+}
+
+// frameBytes reads a length prefixed field from the frame body and returns the rest.
+func frameBytes(body []byte) ([]byte, []byte, error) {
+	l, rest, err := frameUvarint(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l > uint64(len(rest)) {
+		return nil, nil, fmt.Errorf("frame is truncated")
+	}
+	return rest[:l], rest[l:], nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
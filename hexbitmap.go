@@ -1,10 +1,27 @@
 package utils
 
-import "encoding/json"
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Text encodings of HexBitmap.Bits, an empty encoding is hex.
+const (
+	// HexBitmapEncodingHex writes every 4 bits as an uppercase hex digit
+	HexBitmapEncodingHex = "hex"
+	// HexBitmapEncodingRanges writes the set bits as ranges, like "1-100,205,300-310"
+	HexBitmapEncodingRanges = "ranges"
+	// HexBitmapEncodingBase64 writes the base64 of the compressed binary form
+	HexBitmapEncodingBase64 = "base64"
+)
 
 type HexBitmap struct {
-	Size uint32 `json:"size,omitempty"`
-	Bits string `json:"bits,omitempty"`
+	Size     uint32 `json:"size,omitempty"`
+	Bits     string `json:"bits,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
 }
 
 func (b *Bitmap) ToHexBitmap() *HexBitmap {
@@ -14,52 +31,154 @@ func (b *Bitmap) ToHexBitmap() *HexBitmap {
 	}
 }
 
+// ToHexBitmapWith returns the HexBitmap with the bits written in the given encoding.
+func (b *Bitmap) ToHexBitmapWith(encoding string) (*HexBitmap, error) {
+	h := &HexBitmap{Size: b.size, Encoding: encoding}
+	switch encoding {
+	case "", HexBitmapEncodingHex:
+		h.Bits = b.ToString()
+	case HexBitmapEncodingRanges:
+		h.Bits = b.ToRanges()
+	case HexBitmapEncodingBase64:
+		data, err := b.ToRoaring().MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		h.Bits = base64.StdEncoding.EncodeToString(data)
+	default:
+		return nil, fmt.Errorf("bitmap: unknown encoding '%s'", encoding)
+	}
+	return h, nil
+}
+
 func (h *HexBitmap) ToBitmap() (*Bitmap, error) {
-	return FromString(h.Bits, h.Size)
+	var b *Bitmap
+	var err error
+	switch h.Encoding {
+	case "", HexBitmapEncodingHex:
+		b, err = FromString(h.Bits, h.Size)
+	case HexBitmapEncodingRanges:
+		b, err = FromRanges(h.Bits, h.Size)
+	case HexBitmapEncodingBase64:
+		b, err = fromBase64(h.Bits, h.Size)
+	default:
+		err = fmt.Errorf("bitmap: unknown encoding '%s'", h.Encoding)
+	}
+
+	switch {
+	case err != nil:
+		return nil, err
+	case b == nil:
+		return NewBitmap(h.Size), nil
+	}
+	return b, nil
 }
 
 func (b *Bitmap) MarshalJSON() ([]byte, error) {
 	return json.Marshal(b.ToHexBitmap())
 }
 
-func (b *Bitmap) UnmarshalJSON(data []byte) (err error) {
+func (b *Bitmap) UnmarshalJSON(data []byte) error {
 	hb := HexBitmap{}
-	if err = json.Unmarshal(data, &hb); err != nil {
-		return
+	if err := json.Unmarshal(data, &hb); err != nil {
+		return err
 	}
-	b, err = hb.ToBitmap()
-	return
-}
-
-func (h *HexBitmap) Set(x uint32) error {
-	b, err := h.ToBitmap()
+	out, err := hb.ToBitmap()
 	if err != nil {
 		return err
 	}
-	b.Set(x)
-	out := b.ToHexBitmap()
-	*h = *out
+	*b = *out
 	return nil
 }
 
+func (h *HexBitmap) Set(x uint32) error {
+	return h.update(func(b *Bitmap) { b.Set(x) })
+}
+
 func (h *HexBitmap) Remove(x uint32) error {
+	return h.update(func(b *Bitmap) { b.Remove(x) })
+}
+
+func (h *HexBitmap) Grow(x uint32) error {
+	return h.update(func(b *Bitmap) { b.Grow(x) })
+}
+
+// update decodes the bitmap, applies f and encodes it back in the same encoding.
+func (h *HexBitmap) update(f func(b *Bitmap)) error {
 	b, err := h.ToBitmap()
 	if err != nil {
 		return err
 	}
-	b.Remove(x)
-	out := b.ToHexBitmap()
+	f(b)
+	out, err := b.ToHexBitmapWith(h.Encoding)
+	if err != nil {
+		return err
+	}
 	*h = *out
 	return nil
 }
 
-func (h *HexBitmap) Grow(x uint32) error {
-	b, err := h.ToBitmap()
+// ToRanges returns the set bits as comma separated ranges, like "1-100,205,300-310"
+func (b *Bitmap) ToRanges() string {
+	var sb strings.Builder
+	b.setRuns(func(lo, hi uint32) {
+		if sb.Len() > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(strconv.FormatUint(uint64(lo), 10))
+		if hi > lo {
+			sb.WriteString("-")
+			sb.WriteString(strconv.FormatUint(uint64(hi), 10))
+		}
+	})
+	return sb.String()
+}
+
+// FromRanges decodes comma separated ranges written by ToRanges, the bitmap
+// grows beyond cap if a range ends after it.
+func FromRanges(ranges string, cap uint32) (*Bitmap, error) {
+	b := NewBitmap(cap)
+	if ranges == "" {
+		return b, nil
+	}
+
+	for _, part := range strings.Split(ranges, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		lo, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bitmap: bad range '%s': %s", part, err.Error())
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 32); err != nil {
+				return nil, fmt.Errorf("bitmap: bad range '%s': %s", part, err.Error())
+			}
+		}
+		if lo == 0 || lo > hi {
+			return nil, fmt.Errorf("bitmap: bad range '%s'", part)
+		}
+		b.SetRange(uint32(lo), uint32(hi))
+	}
+	return b, nil
+}
+
+// fromBase64 decodes the base64 of the compressed binary form.
+func fromBase64(encoded string, cap uint32) (*Bitmap, error) {
+	if encoded == "" {
+		return NewBitmap(cap), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	b.Grow(x)
-	out := b.ToHexBitmap()
-	*h = *out
-	return nil
+
+	r := NewRoaringBitmap()
+	if err := r.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	b := r.ToBitmap()
+	if cap > b.size {
+		b.Grow(cap)
+	}
+	return b, nil
 }
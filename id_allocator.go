@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IDAllocator hands out IDs from 1 to size. Reserved IDs are never allocated,
+// IDs allocated with a lease are released once the lease expires. Expired
+// leases are collected lazily by every call.
+type IDAllocator struct {
+	// Encoding of the bitmaps in the JSON snapshot, see HexBitmap
+	Encoding  string
+	lock      sync.Mutex
+	allocated *Bitmap
+	reserved  *Bitmap
+	leases    map[uint32]time.Time
+}
+
+type idAllocatorJSON struct {
+	Allocated *HexBitmap           `json:"allocated"`
+	Reserved  *HexBitmap           `json:"reserved,omitempty"`
+	Leases    map[uint32]time.Time `json:"leases,omitempty"`
+}
+
+func NewIDAllocator(size uint32) *IDAllocator {
+	return &IDAllocator{
+		allocated: NewBitmap(size),
+		reserved:  NewBitmap(size),
+		leases:    map[uint32]time.Time{},
+	}
+}
+
+// Reserve excludes the IDs from lo to hi inclusive from allocation, they must not be allocated.
+func (a *IDAllocator) Reserve(lo, hi uint32) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.expireLocked(time.Now())
+	if lo == 0 || lo > hi || hi > a.allocated.size {
+		return fmt.Errorf("reserve range %d-%d is out of range 1-%d", lo, hi, a.allocated.size)
+	}
+	if n := a.allocated.CountRange(lo, hi) - a.reserved.CountRange(lo, hi); n > 0 {
+		return fmt.Errorf("reserve range %d-%d has %d allocated ids", lo, hi, n)
+	}
+	a.reserved.SetRange(lo, hi)
+	a.allocated.SetRange(lo, hi)
+	return nil
+}
+
+// Allocate allocates the smallest free ID.
+func (a *IDAllocator) Allocate() (uint32, error) {
+	return a.allocate(0)
+}
+
+// AllocateWithLease allocates the smallest free ID, which is released after ttl unless renewed.
+func (a *IDAllocator) AllocateWithLease(ttl time.Duration) (uint32, error) {
+	return a.allocate(ttl)
+}
+
+// AllocateSpecific allocates the given ID if it is free.
+func (a *IDAllocator) AllocateSpecific(id uint32) error {
+	return a.allocateSpecific(id, 0)
+}
+
+// AllocateSpecificWithLease allocates the given ID if it is free, it is released after ttl unless renewed.
+func (a *IDAllocator) AllocateSpecificWithLease(id uint32, ttl time.Duration) error {
+	return a.allocateSpecific(id, ttl)
+}
+
+// Renew extends the lease of an allocated ID to ttl from now, a ttl of 0 makes it permanent.
+func (a *IDAllocator) Renew(id uint32, ttl time.Duration) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	a.expireLocked(now)
+	if !a.allocated.Contains(id) || a.reserved.Contains(id) {
+		return fmt.Errorf("id %d is not allocated", id)
+	}
+	a.leaseLocked(id, now, ttl)
+	return nil
+}
+
+// Release frees an allocated ID.
+func (a *IDAllocator) Release(id uint32) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.expireLocked(time.Now())
+	switch {
+	case a.reserved.Contains(id):
+		return fmt.Errorf("id %d is reserved", id)
+	case !a.allocated.Contains(id):
+		return fmt.Errorf("id %d is not allocated", id)
+	}
+	a.allocated.Remove(id)
+	delete(a.leases, id)
+	return nil
+}
+
+// Contains checks whether the ID is allocated or reserved.
+func (a *IDAllocator) Contains(id uint32) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.expireLocked(time.Now())
+	return a.allocated.Contains(id)
+}
+
+// Count returns the number of allocated IDs, reserved IDs are not counted.
+func (a *IDAllocator) Count() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.expireLocked(time.Now())
+	return a.allocated.Count() - a.reserved.Count()
+}
+
+// Expire releases the IDs whose lease has expired and returns them.
+func (a *IDAllocator) Expire() []uint32 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.expireLocked(time.Now())
+}
+
+func (a *IDAllocator) MarshalJSON() ([]byte, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	allocated, err := a.allocated.ToHexBitmapWith(a.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := a.reserved.ToHexBitmapWith(a.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(idAllocatorJSON{
+		Allocated: allocated,
+		Reserved:  reserved,
+		Leases:    a.leases,
+	})
+}
+
+func (a *IDAllocator) UnmarshalJSON(data []byte) error {
+	in := idAllocatorJSON{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.Allocated == nil {
+		return fmt.Errorf("id allocator snapshot has no allocated bitmap")
+	}
+
+	allocated, err := in.Allocated.ToBitmap()
+	if err != nil {
+		return err
+	}
+	reserved := NewBitmap(allocated.size)
+	if in.Reserved != nil {
+		if reserved, err = in.Reserved.ToBitmap(); err != nil {
+			return err
+		}
+	}
+	if in.Leases == nil {
+		in.Leases = map[uint32]time.Time{}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.Encoding = in.Allocated.Encoding
+	a.allocated = allocated
+	a.reserved = reserved
+	a.leases = in.Leases
+	return nil
+}
+
+func (a *IDAllocator) allocate(ttl time.Duration) (uint32, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	a.expireLocked(now)
+	id, ok := a.allocated.MinZero()
+	if !ok {
+		return 0, fmt.Errorf("ids are exhausted")
+	}
+	a.allocated.Set(id)
+	a.leaseLocked(id, now, ttl)
+	return id, nil
+}
+
+func (a *IDAllocator) allocateSpecific(id uint32, ttl time.Duration) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	a.expireLocked(now)
+	switch {
+	case id == 0 || id > a.allocated.size:
+		return fmt.Errorf("id %d is out of range 1-%d", id, a.allocated.size)
+	case a.reserved.Contains(id):
+		return fmt.Errorf("id %d is reserved", id)
+	case a.allocated.Contains(id):
+		return fmt.Errorf("id %d is already allocated", id)
+	}
+	a.allocated.Set(id)
+	a.leaseLocked(id, now, ttl)
+	return nil
+}
+
+func (a *IDAllocator) leaseLocked(id uint32, now time.Time, ttl time.Duration) {
+	if ttl > 0 {
+		a.leases[id] = now.Add(ttl)
+	} else {
+		delete(a.leases, id)
+	}
+}
+
+func (a *IDAllocator) expireLocked(now time.Time) (expired []uint32) {
+	for id, deadline := range a.leases {
+		if now.After(deadline) {
+			a.allocated.Remove(id)
+			delete(a.leases, id)
+			expired = append(expired, id)
+		}
+	}
+	return
+}
@@ -0,0 +1,852 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// arrayMaxSize is the largest cardinality kept in an array container,
+	// above that a bitset container is smaller.
+	arrayMaxSize = 4096
+
+	// bitsetWords is the number of words needed to hold a 64K chunk.
+	bitsetWords = 1 << 16 / 64
+
+	containerArray  = "array"
+	containerBitset = "bitset"
+	containerRun    = "run"
+)
+
+// RoaringBitmap is a compressed bitmap which splits the uint32 space into 64K
+// chunks and stores each chunk in an array, bitset or run container, whichever
+// is the smallest for its content.
+type RoaringBitmap struct {
+	keys       []uint16
+	containers []container
+}
+
+// container stores the low 16 bits of the values in one 64K chunk. Mutating
+// methods return the container to keep, which may have changed its kind.
+type container interface {
+	kind() string
+	add(x uint16) container
+	remove(x uint16) container
+	contains(x uint16) bool
+	cardinality() int
+	minimum() uint16
+	maximum() uint16
+	iterate(f func(x uint16) bool) bool
+	toBitset() *bitsetContainer
+	clone() container
+}
+
+func NewRoaringBitmap() *RoaringBitmap {
+	return &RoaringBitmap{}
+}
+
+// Set sets the value x in the bitmap.
+func (r *RoaringBitmap) Set(x uint32) {
+	hi, lo := uint16(x>>16), uint16(x)
+	i, found := r.search(hi)
+	if !found {
+		r.keys = append(r.keys, 0)
+		copy(r.keys[i+1:], r.keys[i:])
+		r.keys[i] = hi
+		r.containers = append(r.containers, nil)
+		copy(r.containers[i+1:], r.containers[i:])
+		r.containers[i] = &arrayContainer{}
+	}
+	r.containers[i] = r.containers[i].add(lo)
+}
+
+// Remove removes the value x from the bitmap.
+func (r *RoaringBitmap) Remove(x uint32) {
+	i, found := r.search(uint16(x >> 16))
+	if !found {
+		return
+	}
+	if c := r.containers[i].remove(uint16(x)); c.cardinality() > 0 {
+		r.containers[i] = c
+	} else {
+		r.removeAt(i)
+	}
+}
+
+// Contains checks whether a value is contained in the bitmap or not.
+func (r *RoaringBitmap) Contains(x uint32) bool {
+	i, found := r.search(uint16(x >> 16))
+	return found && r.containers[i].contains(uint16(x))
+}
+
+// Min get the smallest value stored in this bitmap, assuming the bitmap is not empty.
+func (r *RoaringBitmap) Min() (uint32, bool) {
+	if len(r.keys) == 0 {
+		return 0, false
+	}
+	return uint32(r.keys[0])<<16 | uint32(r.containers[0].minimum()), true
+}
+
+// Max get the largest value stored in this bitmap, assuming the bitmap is not empty.
+func (r *RoaringBitmap) Max() (uint32, bool) {
+	last := len(r.keys) - 1
+	if last < 0 {
+		return 0, false
+	}
+	return uint32(r.keys[last])<<16 | uint32(r.containers[last].maximum()), true
+}
+
+// Count returns the number of elements in this bitmap
+func (r *RoaringBitmap) Count() int {
+	sum := 0
+	for _, c := range r.containers {
+		sum += c.cardinality()
+	}
+	return sum
+}
+
+// Clear removes all the elements from the bitmap.
+func (r *RoaringBitmap) Clear() {
+	r.keys = r.keys[:0]
+	r.containers = r.containers[:0]
+}
+
+// RunOptimize converts every container to its smallest representation, which
+// turns long runs of ones into run containers.
+func (r *RoaringBitmap) RunOptimize() {
+	for i, c := range r.containers {
+		r.containers[i] = optimize(c)
+	}
+}
+
+// And computes the intersection between two bitmaps and stores the result in the current bitmap
+func (a *RoaringBitmap) And(other RoaringBitmap, extra ...RoaringBitmap) {
+	a.and(&other)
+	for i := range extra {
+		a.and(&extra[i])
+	}
+}
+
+// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
+// Operation works as set subtract: a - b
+func (a *RoaringBitmap) AndNot(other RoaringBitmap, extra ...RoaringBitmap) {
+	a.andNot(&other)
+	for i := range extra {
+		a.andNot(&extra[i])
+	}
+}
+
+// Or computes the union between two bitmaps and stores the result in the current bitmap
+func (a *RoaringBitmap) Or(other RoaringBitmap, extra ...RoaringBitmap) {
+	a.or(&other)
+	for i := range extra {
+		a.or(&extra[i])
+	}
+}
+
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap
+func (a *RoaringBitmap) Xor(other RoaringBitmap, extra ...RoaringBitmap) {
+	a.xor(&other)
+	for i := range extra {
+		a.xor(&extra[i])
+	}
+}
+
+// ForEach calls f for every value in ascending order until f returns false.
+func (r *RoaringBitmap) ForEach(f func(x uint32) bool) {
+	for i, c := range r.containers {
+		hi := uint32(r.keys[i]) << 16
+		if !c.iterate(func(lo uint16) bool { return f(hi | uint32(lo)) }) {
+			return
+		}
+	}
+}
+
+// ToBitmap converts the compressed bitmap to a flat bitmap sized to its largest
+// value. Bitmap positions start at 1, so the value 0 is skipped.
+func (r *RoaringBitmap) ToBitmap() *Bitmap {
+	max, _ := r.Max()
+	b := NewBitmap(max)
+	r.ForEach(func(x uint32) bool {
+		if x != 0 {
+			b.Set(x)
+		}
+		return true
+	})
+	return b
+}
+
+// ToRoaring converts the bitmap to its compressed representation, it never
+// contains the value 0.
+func (b *Bitmap) ToRoaring() *RoaringBitmap {
+	r := NewRoaringBitmap()
+	for blkAt, blk := range b.bits {
+		for blk != 0 {
+			bitAt := bits.LeadingZeros64(blk)
+			if x := uint32(blkAt<<6 + bitAt + 1); x <= b.size {
+				r.Set(x)
+			}
+			blk &^= mask(bitAt)
+		}
+	}
+	r.RunOptimize()
+	return r
+}
+
+func (a *RoaringBitmap) and(b *RoaringBitmap) {
+	keys, containers := a.keys[:0], a.containers[:0]
+	for i, j := 0, 0; i < len(a.keys) && j < len(b.keys); {
+		switch {
+		case a.keys[i] < b.keys[j]:
+			i++
+		case a.keys[i] > b.keys[j]:
+			j++
+		default:
+			if c := andContainers(a.containers[i], b.containers[j]); c != nil {
+				keys = append(keys, a.keys[i])
+				containers = append(containers, c)
+			}
+			i++
+			j++
+		}
+	}
+	a.keys, a.containers = keys, containers
+}
+
+func (a *RoaringBitmap) andNot(b *RoaringBitmap) {
+	keys, containers := a.keys[:0], a.containers[:0]
+	for i, j := 0, 0; i < len(a.keys); i++ {
+		for j < len(b.keys) && b.keys[j] < a.keys[i] {
+			j++
+		}
+		c := a.containers[i]
+		if j < len(b.keys) && b.keys[j] == a.keys[i] {
+			c = bitsetOp(c, b.containers[j], func(x, y uint64) uint64 { return x &^ y })
+		}
+		if c != nil {
+			keys = append(keys, a.keys[i])
+			containers = append(containers, c)
+		}
+	}
+	a.keys, a.containers = keys, containers
+}
+
+func (a *RoaringBitmap) or(b *RoaringBitmap) {
+	a.merge(b, func(x, y uint64) uint64 { return x | y })
+}
+
+func (a *RoaringBitmap) xor(b *RoaringBitmap) {
+	a.merge(b, func(x, y uint64) uint64 { return x ^ y })
+}
+
+// merge combines the chunks of both bitmaps, chunks found only in b are copied.
+func (a *RoaringBitmap) merge(b *RoaringBitmap, op func(x, y uint64) uint64) {
+	keys := make([]uint16, 0, len(a.keys)+len(b.keys))
+	containers := make([]container, 0, len(a.keys)+len(b.keys))
+	i, j := 0, 0
+	for i < len(a.keys) || j < len(b.keys) {
+		switch {
+		case j == len(b.keys) || (i < len(a.keys) && a.keys[i] < b.keys[j]):
+			keys = append(keys, a.keys[i])
+			containers = append(containers, a.containers[i])
+			i++
+		case i == len(a.keys) || a.keys[i] > b.keys[j]:
+			keys = append(keys, b.keys[j])
+			containers = append(containers, b.containers[j].clone())
+			j++
+		default:
+			if c := bitsetOp(a.containers[i], b.containers[j], op); c != nil {
+				keys = append(keys, a.keys[i])
+				containers = append(containers, c)
+			}
+			i++
+			j++
+		}
+	}
+	a.keys, a.containers = keys, containers
+}
+
+func (r *RoaringBitmap) search(hi uint16) (int, bool) {
+	i := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= hi })
+	return i, i < len(r.keys) && r.keys[i] == hi
+}
+
+func (r *RoaringBitmap) removeAt(i int) {
+	r.keys = append(r.keys[:i], r.keys[i+1:]...)
+	r.containers = append(r.containers[:i], r.containers[i+1:]...)
+}
+
+// andContainers intersects two containers, returns nil if the result is empty.
+func andContainers(x, y container) container {
+	ax, ok1 := x.(*arrayContainer)
+	ay, ok2 := y.(*arrayContainer)
+	if !ok1 || !ok2 {
+		return bitsetOp(x, y, func(x, y uint64) uint64 { return x & y })
+	}
+
+	out := &arrayContainer{}
+	for i, j := 0, 0; i < len(ax.values) && j < len(ay.values); {
+		switch {
+		case ax.values[i] < ay.values[j]:
+			i++
+		case ax.values[i] > ay.values[j]:
+			j++
+		default:
+			out.values = append(out.values, ax.values[i])
+			i++
+			j++
+		}
+	}
+	if len(out.values) == 0 {
+		return nil
+	}
+	return out
+}
+
+// bitsetOp applies op word by word on the bitset form of both containers and
+// returns the result in its smallest form, or nil if it is empty.
+func bitsetOp(x, y container, op func(x, y uint64) uint64) container {
+	bx, by := x.toBitset(), y.toBitset()
+	out := &bitsetContainer{}
+	for i := range out.words {
+		out.words[i] = op(bx.words[i], by.words[i])
+		out.card += bits.OnesCount64(out.words[i])
+	}
+	if out.card == 0 {
+		return nil
+	}
+	return optimize(out)
+}
+
+// optimize returns the smallest representation of the container.
+func optimize(c container) container {
+	b := c.toBitset()
+	runs := b.numRuns()
+	switch {
+	case 4*runs < 2*b.card && 4*runs < 8*bitsetWords:
+		if c.kind() == containerRun {
+			return c
+		}
+		return b.toRun()
+	case b.card <= arrayMaxSize:
+		if c.kind() == containerArray {
+			return c
+		}
+		return b.toArray()
+	default:
+		return b
+	}
+}
+
+// arrayContainer keeps a sorted list of values.
+type arrayContainer struct {
+	values []uint16
+}
+
+func (a *arrayContainer) kind() string {
+	return containerArray
+}
+
+func (a *arrayContainer) search(x uint16) (int, bool) {
+	i := sort.Search(len(a.values), func(i int) bool { return a.values[i] >= x })
+	return i, i < len(a.values) && a.values[i] == x
+}
+
+func (a *arrayContainer) add(x uint16) container {
+	i, found := a.search(x)
+	if found {
+		return a
+	}
+	if len(a.values) >= arrayMaxSize {
+		return a.toBitset().add(x)
+	}
+	a.values = append(a.values, 0)
+	copy(a.values[i+1:], a.values[i:])
+	a.values[i] = x
+	return a
+}
+
+func (a *arrayContainer) remove(x uint16) container {
+	if i, found := a.search(x); found {
+		a.values = append(a.values[:i], a.values[i+1:]...)
+	}
+	return a
+}
+
+func (a *arrayContainer) contains(x uint16) bool {
+	_, found := a.search(x)
+	return found
+}
+
+func (a *arrayContainer) cardinality() int {
+	return len(a.values)
+}
+
+func (a *arrayContainer) minimum() uint16 {
+	return a.values[0]
+}
+
+func (a *arrayContainer) maximum() uint16 {
+	return a.values[len(a.values)-1]
+}
+
+func (a *arrayContainer) iterate(f func(x uint16) bool) bool {
+	for _, x := range a.values {
+		if !f(x) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *arrayContainer) toBitset() *bitsetContainer {
+	b := &bitsetContainer{card: len(a.values)}
+	for _, x := range a.values {
+		b.words[x>>6] |= 1 << (x & 63)
+	}
+	return b
+}
+
+func (a *arrayContainer) clone() container {
+	return &arrayContainer{values: append([]uint16(nil), a.values...)}
+}
+
+// bitsetContainer keeps one bit per value of the chunk.
+type bitsetContainer struct {
+	words [bitsetWords]uint64
+	card  int
+}
+
+func (b *bitsetContainer) kind() string {
+	return containerBitset
+}
+
+func (b *bitsetContainer) add(x uint16) container {
+	if !b.contains(x) {
+		b.words[x>>6] |= 1 << (x & 63)
+		b.card++
+	}
+	return b
+}
+
+func (b *bitsetContainer) remove(x uint16) container {
+	if b.contains(x) {
+		b.words[x>>6] &^= 1 << (x & 63)
+		b.card--
+	}
+	if b.card <= arrayMaxSize {
+		return b.toArray()
+	}
+	return b
+}
+
+func (b *bitsetContainer) contains(x uint16) bool {
+	return b.words[x>>6]&(1<<(x&63)) != 0
+}
+
+func (b *bitsetContainer) cardinality() int {
+	return b.card
+}
+
+func (b *bitsetContainer) minimum() uint16 {
+	for i, w := range b.words {
+		if w != 0 {
+			return uint16(i<<6 + bits.TrailingZeros64(w))
+		}
+	}
+	return 0
+}
+
+func (b *bitsetContainer) maximum() uint16 {
+	for i := len(b.words) - 1; i >= 0; i-- {
+		if w := b.words[i]; w != 0 {
+			return uint16(i<<6 + 63 - bits.LeadingZeros64(w))
+		}
+	}
+	return 0
+}
+
+func (b *bitsetContainer) iterate(f func(x uint16) bool) bool {
+	for i, w := range b.words {
+		for w != 0 {
+			if !f(uint16(i<<6 + bits.TrailingZeros64(w))) {
+				return false
+			}
+			w &= w - 1
+		}
+	}
+	return true
+}
+
+func (b *bitsetContainer) toBitset() *bitsetContainer {
+	return b
+}
+
+func (b *bitsetContainer) clone() container {
+	out := *b
+	return &out
+}
+
+func (b *bitsetContainer) toArray() *arrayContainer {
+	a := &arrayContainer{values: make([]uint16, 0, b.card)}
+	b.iterate(func(x uint16) bool {
+		a.values = append(a.values, x)
+		return true
+	})
+	return a
+}
+
+func (b *bitsetContainer) toRun() *runContainer {
+	r := &runContainer{}
+	b.iterate(func(x uint16) bool {
+		if n := len(r.runs); n > 0 && r.runs[n-1].last+1 == x {
+			r.runs[n-1].last = x
+		} else {
+			r.runs = append(r.runs, interval16{start: x, last: x})
+		}
+		return true
+	})
+	return r
+}
+
+// numRuns counts the runs of consecutive ones, a run starts where a bit is
+// set and the bit before it is not.
+func (b *bitsetContainer) numRuns() int {
+	runs := 0
+	var prev uint64
+	for _, w := range b.words {
+		runs += bits.OnesCount64(w &^ (w<<1 | prev>>63))
+		prev = w
+	}
+	return runs
+}
+
+// runContainer keeps a sorted list of non-adjacent intervals.
+type runContainer struct {
+	runs []interval16
+}
+
+type interval16 struct {
+	start uint16
+	last  uint16
+}
+
+func (r *runContainer) kind() string {
+	return containerRun
+}
+
+// search returns the index of the first run which ends at or after x.
+func (r *runContainer) search(x uint16) int {
+	return sort.Search(len(r.runs), func(i int) bool { return r.runs[i].last >= x })
+}
+
+func (r *runContainer) add(x uint16) container {
+	i := r.search(x)
+	if i < len(r.runs) && r.runs[i].start <= x {
+		return r
+	}
+
+	joinPrev := i > 0 && r.runs[i-1].last+1 == x
+	joinNext := i < len(r.runs) && r.runs[i].start-1 == x
+	switch {
+	case joinPrev && joinNext:
+		r.runs[i-1].last = r.runs[i].last
+		r.runs = append(r.runs[:i], r.runs[i+1:]...)
+	case joinPrev:
+		r.runs[i-1].last = x
+	case joinNext:
+		r.runs[i].start = x
+	default:
+		r.runs = append(r.runs, interval16{})
+		copy(r.runs[i+1:], r.runs[i:])
+		r.runs[i] = interval16{start: x, last: x}
+		if 4*len(r.runs) >= 8*bitsetWords || 4*len(r.runs) >= 2*r.cardinality() {
+			return optimize(r)
+		}
+	}
+	return r
+}
+
+func (r *runContainer) remove(x uint16) container {
+	i := r.search(x)
+	if i == len(r.runs) || r.runs[i].start > x {
+		return r
+	}
+
+	run := r.runs[i]
+	switch {
+	case run.start == x && run.last == x:
+		r.runs = append(r.runs[:i], r.runs[i+1:]...)
+	case run.start == x:
+		r.runs[i].start++
+	case run.last == x:
+		r.runs[i].last--
+	default:
+		r.runs = append(r.runs, interval16{})
+		copy(r.runs[i+1:], r.runs[i:])
+		r.runs[i].last = x - 1
+		r.runs[i+1].start = x + 1
+		if 4*len(r.runs) >= 8*bitsetWords || 4*len(r.runs) >= 2*r.cardinality() {
+			return optimize(r)
+		}
+	}
+	return r
+}
+
+func (r *runContainer) contains(x uint16) bool {
+	i := r.search(x)
+	return i < len(r.runs) && r.runs[i].start <= x
+}
+
+func (r *runContainer) cardinality() int {
+	card := 0
+	for _, run := range r.runs {
+		card += int(run.last-run.start) + 1
+	}
+	return card
+}
+
+func (r *runContainer) minimum() uint16 {
+	return r.runs[0].start
+}
+
+func (r *runContainer) maximum() uint16 {
+	return r.runs[len(r.runs)-1].last
+}
+
+func (r *runContainer) iterate(f func(x uint16) bool) bool {
+	for _, run := range r.runs {
+		for x := int(run.start); x <= int(run.last); x++ {
+			if !f(uint16(x)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r *runContainer) toBitset() *bitsetContainer {
+	b := &bitsetContainer{}
+	for _, run := range r.runs {
+		for x := int(run.start); x <= int(run.last); x++ {
+			b.words[x>>6] |= 1 << (x & 63)
+		}
+		b.card += int(run.last-run.start) + 1
+	}
+	return b
+}
+
+func (r *runContainer) clone() container {
+	return &runContainer{runs: append([]interval16(nil), r.runs...)}
+}
+
+// roaringJSON is the serialized form of RoaringBitmap, each container holds
+// its little-endian payload which is base64 encoded by encoding/json.
+type roaringJSON struct {
+	Containers []roaringContainerJSON `json:"containers,omitempty"`
+}
+
+type roaringContainerJSON struct {
+	Key  uint16 `json:"key"`
+	Type string `json:"type"`
+	Data []byte `json:"data"`
+}
+
+func (r *RoaringBitmap) MarshalJSON() ([]byte, error) {
+	out := roaringJSON{}
+	for i, c := range r.containers {
+		out.Containers = append(out.Containers, roaringContainerJSON{
+			Key:  r.keys[i],
+			Type: c.kind(),
+			Data: encodeContainer(c),
+		})
+	}
+	return json.Marshal(out)
+}
+
+func (r *RoaringBitmap) UnmarshalJSON(data []byte) error {
+	in := roaringJSON{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	out := RoaringBitmap{}
+	for _, cj := range in.Containers {
+		if err := out.appendContainer(cj.Key, cj.Type, cj.Data); err != nil {
+			return err
+		}
+	}
+	*r = out
+	return nil
+}
+
+// Binary format of a compressed bitmap, integers are big-endian:
+//
+//	magic   [2]byte  "RB"
+//	version uint8    roaringBinaryVersion
+//	count   uint32   number of containers
+//	count times:
+//	  key   uint16
+//	  type  uint8    index in roaringBinaryTypes
+//	  len   uint32   payload length, the payload is the same as in JSON
+//	crc     uint32   IEEE CRC-32 of everything before it
+const (
+	roaringBinaryVersion uint8 = 1
+	roaringBinaryHeader        = 7
+)
+
+var (
+	roaringBinaryMagic = [2]byte{'R', 'B'}
+	roaringBinaryTypes = []string{containerArray, containerBitset, containerRun}
+)
+
+// MarshalBinary encodes the compressed bitmap in a compact binary form.
+func (r *RoaringBitmap) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, roaringBinaryHeader, roaringBinaryHeader+7*len(r.keys)+4)
+	copy(buf, roaringBinaryMagic[:])
+	buf[2] = roaringBinaryVersion
+	binary.BigEndian.PutUint32(buf[3:], uint32(len(r.keys)))
+
+	var hdr [7]byte
+	for i, c := range r.containers {
+		data := encodeContainer(c)
+		binary.BigEndian.PutUint16(hdr[:], r.keys[i])
+		for t, kind := range roaringBinaryTypes {
+			if kind == c.kind() {
+				hdr[2] = uint8(t)
+			}
+		}
+		binary.BigEndian.PutUint32(hdr[3:], uint32(len(data)))
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, data...)
+	}
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(buf))
+	return append(buf, crc[:]...), nil
+}
+
+// UnmarshalBinary decodes a compressed bitmap encoded by MarshalBinary.
+func (r *RoaringBitmap) UnmarshalBinary(data []byte) error {
+	if len(data) < roaringBinaryHeader+4 {
+		return fmt.Errorf("bitmap: binary data too short, length %d", len(data))
+	}
+	if data[0] != roaringBinaryMagic[0] || data[1] != roaringBinaryMagic[1] {
+		return fmt.Errorf("bitmap: binary data has bad magic %q", data[:2])
+	}
+	if data[2] != roaringBinaryVersion {
+		return fmt.Errorf("bitmap: unsupported binary version %d", data[2])
+	}
+
+	crcAt := len(data) - 4
+	if crc := crc32.ChecksumIEEE(data[:crcAt]); crc != binary.BigEndian.Uint32(data[crcAt:]) {
+		return fmt.Errorf("bitmap: binary data checksum mismatch")
+	}
+
+	out := RoaringBitmap{}
+	count := binary.BigEndian.Uint32(data[3:])
+	body := data[roaringBinaryHeader:crcAt]
+	for i := uint32(0); i < count; i++ {
+		if len(body) < 7 {
+			return fmt.Errorf("bitmap: binary data truncated at container %d", i)
+		}
+		key, t, n := binary.BigEndian.Uint16(body), int(body[2]), binary.BigEndian.Uint32(body[3:])
+		if t >= len(roaringBinaryTypes) || uint64(n) > uint64(len(body)-7) {
+			return fmt.Errorf("bitmap: binary data has bad container %d", i)
+		}
+		if err := out.appendContainer(key, roaringBinaryTypes[t], body[7:7+n]); err != nil {
+			return err
+		}
+		body = body[7+n:]
+	}
+	if len(body) != 0 {
+		return fmt.Errorf("bitmap: binary data has %d trailing bytes", len(body))
+	}
+
+	*r = out
+	return nil
+}
+
+// encodeContainer returns the little-endian payload of the container.
+func encodeContainer(c container) []byte {
+	var data []byte
+	switch v := c.(type) {
+	case *arrayContainer:
+		data = make([]byte, 2*len(v.values))
+		for j, x := range v.values {
+			binary.LittleEndian.PutUint16(data[2*j:], x)
+		}
+	case *bitsetContainer:
+		data = make([]byte, 8*len(v.words))
+		for j, w := range v.words {
+			binary.LittleEndian.PutUint64(data[8*j:], w)
+		}
+	case *runContainer:
+		data = make([]byte, 4*len(v.runs))
+		for j, run := range v.runs {
+			binary.LittleEndian.PutUint16(data[4*j:], run.start)
+			binary.LittleEndian.PutUint16(data[4*j+2:], run.last)
+		}
+	}
+	return data
+}
+
+// appendContainer decodes a container payload and appends it, keys have to
+// be appended in ascending order.
+func (r *RoaringBitmap) appendContainer(key uint16, kind string, data []byte) error {
+	if n := len(r.keys); n > 0 && r.keys[n-1] >= key {
+		return fmt.Errorf("bitmap: container keys are not sorted at %d", key)
+	}
+
+	var c container
+	switch kind {
+	case containerArray:
+		if len(data)%2 != 0 {
+			return fmt.Errorf("bitmap: array container length expected to be multiple of 2, was %d", len(data))
+		}
+		a := &arrayContainer{values: make([]uint16, len(data)/2)}
+		for j := range a.values {
+			a.values[j] = binary.LittleEndian.Uint16(data[2*j:])
+			if j > 0 && a.values[j-1] >= a.values[j] {
+				return fmt.Errorf("bitmap: array container values are not sorted at %d", a.values[j])
+			}
+		}
+		c = a
+	case containerBitset:
+		if len(data) != 8*bitsetWords {
+			return fmt.Errorf("bitmap: bitset container length expected to be %d, was %d", 8*bitsetWords, len(data))
+		}
+		b := &bitsetContainer{}
+		for j := range b.words {
+			b.words[j] = binary.LittleEndian.Uint64(data[8*j:])
+			b.card += bits.OnesCount64(b.words[j])
+		}
+		c = b
+	case containerRun:
+		if len(data)%4 != 0 {
+			return fmt.Errorf("bitmap: run container length expected to be multiple of 4, was %d", len(data))
+		}
+		rc := &runContainer{runs: make([]interval16, len(data)/4)}
+		for j := range rc.runs {
+			rc.runs[j].start = binary.LittleEndian.Uint16(data[4*j:])
+			rc.runs[j].last = binary.LittleEndian.Uint16(data[4*j+2:])
+			if rc.runs[j].start > rc.runs[j].last || (j > 0 && int(rc.runs[j-1].last)+1 >= int(rc.runs[j].start)) {
+				return fmt.Errorf("bitmap: run container runs are not sorted at %d", rc.runs[j].start)
+			}
+		}
+		c = rc
+	default:
+		return fmt.Errorf("bitmap: unknown container type '%s'", kind)
+	}
+
+	if c.cardinality() == 0 {
+		return nil
+	}
+	r.keys = append(r.keys, key)
+	r.containers = append(r.containers, c)
+	return nil
+}